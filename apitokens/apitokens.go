@@ -0,0 +1,227 @@
+package apitokens
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"languageboostergo/auth"
+	"languageboostergo/db"
+	"languageboostergo/tokens"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var conn = db.GetDb()
+
+// TokenPrefix distinguishes API tokens from JWTs in the Authorization header
+const TokenPrefix = "lb_"
+
+const (
+	ScopeExportRead     = "export:read"
+	ScopeImportWrite    = "import:write"
+	ScopeMutationsRead  = "mutations:read"
+	ScopeMutationsWrite = "mutations:write"
+	ScopeLanguagesRead  = "languages:read"
+)
+
+var Scopes = []string{ScopeExportRead, ScopeImportWrite, ScopeMutationsRead, ScopeMutationsWrite, ScopeLanguagesRead}
+
+// lastUsedPrecision limits how often the last used timestamp gets written
+const lastUsedPrecision = time.Minute
+
+type CreateApiTokenDto struct {
+	Name      string   `json:"name" binding:"required"`
+	Scopes    []string `json:"scopes" binding:"required,min=1"`
+	ProjectId *uint    `json:"projectId"`
+	// ExpiresInDays of 0 creates a token which does not expire
+	ExpiresInDays int `json:"expiresInDays" binding:"min=0"`
+}
+
+type SimpleApiToken struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	ProjectID  *uint      `json:"projectId"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+}
+
+func toSimpleApiToken(token db.ApiToken) SimpleApiToken {
+	return SimpleApiToken{
+		ID:         token.ID,
+		Name:       token.Name,
+		Prefix:     token.Prefix,
+		ProjectID:  token.ProjectID,
+		Scopes:     splitScopes(token.Scopes),
+		CreatedAt:  token.CreatedAt,
+		ExpiresAt:  token.ExpiresAt,
+		LastUsedAt: token.LastUsedAt,
+		RevokedAt:  token.RevokedAt,
+	}
+}
+
+func splitScopes(scopes string) []string {
+	if scopes == "" {
+		return []string{}
+	}
+	return strings.Split(scopes, ",")
+}
+
+func isScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope checks whether the token was granted the scope
+func HasScope(token db.ApiToken, scope string) bool {
+	for _, s := range splitScopes(token.Scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IsApiToken tells whether the Authorization header carries an API token instead of a JWT
+func IsApiToken(header string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(header, "Bearer "), TokenPrefix)
+}
+
+// Authenticate resolves an API token from the Authorization header,
+// revoked and expired tokens are rejected
+func Authenticate(header string) (db.ApiToken, error) {
+	var token db.ApiToken
+	plain := strings.TrimPrefix(header, "Bearer ")
+
+	err := conn.Where("token_hash = ?", tokens.Hash(plain)).First(&token).Error
+	if err != nil {
+		return token, errors.New("invalid token")
+	}
+
+	now := time.Now()
+	if token.RevokedAt != nil {
+		return token, errors.New("token was revoked")
+	}
+	if token.ExpiresAt != nil && now.After(*token.ExpiresAt) {
+		return token, errors.New("token has expired")
+	}
+
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > lastUsedPrecision {
+		conn.Model(&token).Update("last_used_at", now)
+	}
+
+	return token, nil
+}
+
+func CreateApiToken(c *gin.Context) {
+	var request CreateApiTokenDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, scope := range request.Scopes {
+		if !isScope(scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Unknown scope " + scope, "scopes": Scopes})
+			return
+		}
+	}
+
+	userId := c.MustGet("userId").(uint)
+
+	// Project tokens are managed by whoever manages the project
+	if request.ProjectId != nil && (!auth.RequestAllowsProject(c, *request.ProjectId) || !auth.CanInProject(userId, *request.ProjectId, auth.PermissionProjectsManage)) {
+		c.JSON(403, "You are not allowed to create tokens for this project")
+		return
+	}
+
+	plain, err := tokens.Random(32)
+	if err != nil {
+		c.JSON(500, "Error creating token")
+		return
+	}
+	plain = TokenPrefix + plain
+
+	token := db.ApiToken{
+		Name:      request.Name,
+		UserID:    userId,
+		ProjectID: request.ProjectId,
+		Scopes:    strings.Join(request.Scopes, ","),
+		Prefix:    plain[:len(TokenPrefix)+6],
+		TokenHash: tokens.Hash(plain),
+		// Tokens created in a password session cannot reach spaces requiring single sign-on
+		AuthMethod: c.GetString("authMethod"),
+	}
+	if request.ExpiresInDays > 0 {
+		expiresAt := time.Now().Add(time.Duration(request.ExpiresInDays) * 24 * time.Hour)
+		token.ExpiresAt = &expiresAt
+	}
+
+	conn.Create(&token)
+
+	// The plain token is returned only once
+	c.JSON(200, gin.H{"token": plain, "apiToken": toSimpleApiToken(token)})
+}
+
+func ListApiTokens(c *gin.Context) {
+	userId := c.MustGet("userId").(uint)
+
+	var apiTokens []db.ApiToken
+	query := conn.Where("user_id = ?", userId)
+	if projectId := c.Query("projectId"); projectId != "" {
+		projectIdParam, err := strconv.ParseUint(projectId, 10, 32)
+		if err != nil {
+			c.JSON(405, "Project ID is invalid")
+			return
+		}
+		if !auth.RequestAllowsProject(c, uint(projectIdParam)) || !auth.CanInProject(userId, uint(projectIdParam), auth.PermissionProjectsManage) {
+			c.JSON(403, "You are not allowed to manage tokens of this project")
+			return
+		}
+		query = conn.Where("project_id = ?", uint(projectIdParam))
+	}
+	query.Order("created_at desc").Find(&apiTokens)
+
+	simpleTokens := make([]SimpleApiToken, len(apiTokens))
+	for i, v := range apiTokens {
+		simpleTokens[i] = toSimpleApiToken(v)
+	}
+
+	c.JSON(200, simpleTokens)
+}
+
+func RevokeApiToken(c *gin.Context) {
+	tokenIdParam, err := strconv.ParseUint(c.Param("tokenId"), 10, 32)
+	if err != nil {
+		panic("Token ID is not number serializable")
+	}
+
+	var token db.ApiToken
+	if err := conn.First(&token, uint(tokenIdParam)).Error; err != nil {
+		c.JSON(404, "Token does not exist")
+		return
+	}
+
+	userId := c.MustGet("userId").(uint)
+	isProjectManager := token.ProjectID != nil && auth.CanInProject(userId, *token.ProjectID, auth.PermissionProjectsManage)
+	if token.UserID != userId && !isProjectManager {
+		c.JSON(403, "You are not allowed to revoke this token")
+		return
+	}
+
+	if token.RevokedAt == nil {
+		now := time.Now()
+		token.RevokedAt = &now
+		conn.Save(&token)
+	}
+
+	c.JSON(200, toSimpleApiToken(token))
+}
@@ -1,23 +1,57 @@
 package auth
 
 import (
+	"github.com/gin-gonic/gin"
 	"languageboostergo/db"
 )
 
 var conn = db.GetDb()
 
+// IsUserInProject checks whether the user is a member of the project's space with any role
 func IsUserInProject(userId, projectId uint) bool {
-	var foundUsers []db.User
-	err := conn.Joins("JOIN user_spaces ON user_spaces.user_id = users.id").
-		Joins("JOIN spaces ON spaces.id = user_spaces.space_id").
-		Joins("JOIN projects ON projects.space_id = spaces.id").
-		Where("users.id = ?", userId).
-		Where("projects.id = ?", projectId).
-		Find(&foundUsers).Error
+	_, ok := ProjectRole(userId, projectId)
+	return ok
+}
 
+// IsProjectArchived checks whether the project was archived and is therefore read-only
+func IsProjectArchived(projectId uint) bool {
+	var project db.Project
+	err := conn.Select("id", "archived_at").First(&project, projectId).Error
 	if err != nil {
 		return false
 	}
 
-	return len(foundUsers) > 0
+	return project.ArchivedAt != nil
+}
+
+// RequestAllowsProject checks the credentials of the request may reach the project,
+// project API tokens are restricted to their project and the single sign-on policy of the space applies
+func RequestAllowsProject(c *gin.Context, projectId uint) bool {
+	if tokenProjectId, exists := c.Get("tokenProjectId"); exists && tokenProjectId.(uint) != projectId {
+		return false
+	}
+
+	var count int64
+	conn.Model(&db.Project{}).
+		Joins("JOIN spaces ON spaces.id = projects.space_id AND spaces.deleted_at IS NULL").
+		Where("projects.id = ? AND spaces.require_sso = ?", projectId, true).
+		Count(&count)
+	return count == 0 || c.GetString("authMethod") == db.AuthMethodSSO
+}
+
+// RequestAllowsSpace checks the request may reach projects of the space, spaces requiring
+// single sign-on are only reachable from sessions and tokens started through single sign-on
+func RequestAllowsSpace(c *gin.Context, spaceId uint) bool {
+	var space db.Space
+	if err := conn.Select("id", "require_sso").First(&space, spaceId).Error; err != nil {
+		return false
+	}
+	return !space.RequireSSO || c.GetString("authMethod") == db.AuthMethodSSO
+}
+
+// IsAdmin checks whether the user administers the whole installation
+func IsAdmin(userId uint) bool {
+	var user db.User
+	err := conn.Select("id", "is_admin").First(&user, userId).Error
+	return err == nil && user.IsAdmin
 }
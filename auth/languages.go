@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"languageboostergo/db"
+)
+
+// LanguageAccess describes which languages of a project a user may edit
+type LanguageAccess struct {
+	canEdit    bool
+	restricted bool
+	languages  map[uint]bool
+}
+
+// GetLanguageAccess loads the role and the language restrictions of the user in the project
+func GetLanguageAccess(userId, projectId uint) LanguageAccess {
+	role, _ := ProjectRole(userId, projectId)
+	access := LanguageAccess{
+		canEdit:   Can(role, PermissionValuesWrite),
+		languages: make(map[uint]bool),
+	}
+
+	var permissions []db.LanguagePermission
+	conn.Where("user_id = ? AND project_id = ?", userId, projectId).Find(&permissions)
+	for _, permission := range permissions {
+		access.languages[permission.LanguageID] = true
+	}
+	access.restricted = len(permissions) > 0
+
+	return access
+}
+
+// CanEdit checks whether values of the language may be edited
+func (access LanguageAccess) CanEdit(languageId uint) bool {
+	return access.canEdit && (!access.restricted || access.languages[languageId])
+}
+
+// IsLanguageAllowed checks only the language restriction regardless of the role
+func (access LanguageAccess) IsLanguageAllowed(languageId uint) bool {
+	return !access.restricted || access.languages[languageId]
+}
+
+// MarkEditable flags every value of the mutations by whether the user may edit it
+func (access LanguageAccess) MarkEditable(mutations []db.SimpleMutation) {
+	for i := range mutations {
+		for j := range mutations[i].MutationValues {
+			editable := access.CanEdit(mutations[i].MutationValues[j].LanguageID)
+			mutations[i].MutationValues[j].Editable = &editable
+		}
+	}
+}
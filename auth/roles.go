@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"github.com/gin-gonic/gin"
+	"languageboostergo/db"
+)
+
+const (
+	RoleOwner      = "owner"
+	RoleAdmin      = "admin"
+	RoleDeveloper  = "developer"
+	RoleTranslator = "translator"
+	RoleReviewer   = "reviewer"
+	RoleViewer     = "viewer"
+)
+
+// Roles are ordered from the most to the least privileged
+var Roles = []string{RoleOwner, RoleAdmin, RoleDeveloper, RoleTranslator, RoleReviewer, RoleViewer}
+
+type Permission string
+
+const (
+	PermissionRead            Permission = "read"
+	PermissionSpaceUpdate     Permission = "space:update"
+	PermissionSpaceDelete     Permission = "space:delete"
+	PermissionMembersManage   Permission = "members:manage"
+	PermissionProjectsManage  Permission = "projects:manage"
+	PermissionLanguagesManage Permission = "languages:manage"
+	PermissionKeysWrite       Permission = "keys:write"
+	PermissionValuesWrite     Permission = "values:write"
+	PermissionValuesReview    Permission = "values:review"
+)
+
+var rolePermissions = map[string][]Permission{
+	RoleOwner: {
+		PermissionRead, PermissionSpaceUpdate, PermissionSpaceDelete, PermissionMembersManage, PermissionProjectsManage,
+		PermissionLanguagesManage, PermissionKeysWrite, PermissionValuesWrite, PermissionValuesReview,
+	},
+	RoleAdmin: {
+		PermissionRead, PermissionSpaceUpdate, PermissionMembersManage, PermissionProjectsManage,
+		PermissionLanguagesManage, PermissionKeysWrite, PermissionValuesWrite, PermissionValuesReview,
+	},
+	RoleDeveloper:  {PermissionRead, PermissionLanguagesManage, PermissionKeysWrite, PermissionValuesWrite, PermissionValuesReview},
+	RoleTranslator: {PermissionRead, PermissionValuesWrite},
+	RoleReviewer:   {PermissionRead, PermissionValuesReview},
+	RoleViewer:     {PermissionRead},
+}
+
+func IsRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// Can checks whether the role grants the permission
+func Can(role string, permission Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// SpaceMembership returns the role of the user in the space regardless of the space policies,
+// it tells who is a member, permissions are checked with RequestSpaceRole
+func SpaceMembership(userId, spaceId uint) (string, bool) {
+	var membership db.UserSpace
+	err := conn.Joins("JOIN spaces ON spaces.id = user_spaces.space_id AND spaces.deleted_at IS NULL").
+		Where("user_spaces.user_id = ? AND user_spaces.space_id = ?", userId, spaceId).
+		First(&membership).Error
+	if err != nil {
+		return "", false
+	}
+	return membership.Role, true
+}
+
+// spaceRole returns the role of the user in the space, ok is false for non members,
+// members without two-factor authentication have no role when the space requires it
+func spaceRole(userId, spaceId uint) (string, bool) {
+	var membership db.UserSpace
+	err := conn.Joins("JOIN spaces ON spaces.id = user_spaces.space_id AND spaces.deleted_at IS NULL").
+		Joins("JOIN users ON users.id = user_spaces.user_id").
+		Where("user_spaces.user_id = ? AND user_spaces.space_id = ?", userId, spaceId).
+		Where("spaces.require_two_factor = ? OR users.totp_enabled = ?", false, true).
+		First(&membership).Error
+	if err != nil {
+		return "", false
+	}
+	return membership.Role, true
+}
+
+// ProjectRole returns the role of the user in the space owning the project,
+// members without two-factor authentication have no role when the space requires it
+func ProjectRole(userId, projectId uint) (string, bool) {
+	var membership db.UserSpace
+	err := conn.Joins("JOIN spaces ON spaces.id = user_spaces.space_id AND spaces.deleted_at IS NULL").
+		Joins("JOIN projects ON projects.space_id = spaces.id AND projects.deleted_at IS NULL").
+		Joins("JOIN users ON users.id = user_spaces.user_id").
+		Where("user_spaces.user_id = ? AND projects.id = ?", userId, projectId).
+		Where("spaces.require_two_factor = ? OR users.totp_enabled = ?", false, true).
+		First(&membership).Error
+	if err != nil {
+		return "", false
+	}
+	return membership.Role, true
+}
+
+// MeetsTwoFactorPolicy checks the user has two-factor authentication when the space requires it
+func MeetsTwoFactorPolicy(userId, spaceId uint) bool {
+	var space db.Space
+	if err := conn.Select("id", "require_two_factor").First(&space, spaceId).Error; err != nil {
+		return false
+	}
+	if !space.RequireTwoFactor {
+		return true
+	}
+	var user db.User
+	err := conn.Select("id", "totp_enabled").First(&user, userId).Error
+	return err == nil && user.TOTPEnabled
+}
+
+// IsUserInSpace checks the membership, members not meeting the two-factor policy are included
+// so they can still see the space and learn what is required
+func IsUserInSpace(userId, spaceId uint) bool {
+	_, ok := SpaceMembership(userId, spaceId)
+	return ok
+}
+
+// RequestSpaceRole returns the role of the user in the space for the request, credentials
+// not meeting the single sign-on policy of the space get no role
+func RequestSpaceRole(c *gin.Context, userId, spaceId uint) (string, bool) {
+	if !RequestAllowsSpace(c, spaceId) {
+		return "", false
+	}
+	return spaceRole(userId, spaceId)
+}
+
+// CanInSpace checks the user is a member of the space with a role granting the permission
+// and the request meets the policies of the space
+func CanInSpace(c *gin.Context, userId, spaceId uint, permission Permission) bool {
+	role, ok := RequestSpaceRole(c, userId, spaceId)
+	return ok && Can(role, permission)
+}
+
+// CanInProject checks the user is a member of the project's space with a role granting the permission
+func CanInProject(userId, projectId uint, permission Permission) bool {
+	role, ok := ProjectRole(userId, projectId)
+	return ok && Can(role, permission)
+}
+
+// CanAssignRole checks whether the caller may give the role to someone,
+// only owners can hand out the owner role
+func CanAssignRole(callerRole, role string) bool {
+	if !IsRole(role) || !Can(callerRole, PermissionMembersManage) {
+		return false
+	}
+	return role != RoleOwner || callerRole == RoleOwner
+}
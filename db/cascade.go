@@ -0,0 +1,61 @@
+package db
+
+import (
+	"gorm.io/gorm"
+)
+
+// DeleteLanguagesCascade soft deletes languages together with their mutation values
+// and removes them from the fallback chains of other languages and from project sources
+func DeleteLanguagesCascade(tx *gorm.DB, languageIds []uint) error {
+	if len(languageIds) == 0 {
+		return nil
+	}
+	if err := tx.Where("language_id IN ?", languageIds).Delete(&MutationValue{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&Language{}).Where("fallback_id IN ?", languageIds).Update("fallback_id", nil).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&Project{}).Where("source_language_id IN ?", languageIds).Update("source_language_id", nil).Error; err != nil {
+		return err
+	}
+	// A member without any permission row may edit every language, so the last permission
+	// of a member is kept and the member stays restricted instead of gaining all languages
+	otherPermissions := tx.Table("language_permissions AS other").Select("1").
+		Where("other.user_id = language_permissions.user_id AND other.project_id = language_permissions.project_id AND other.language_id NOT IN ?", languageIds)
+	err := tx.Where("language_id IN ? AND EXISTS (?)", languageIds, otherPermissions).Delete(&LanguagePermission{}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Where("id IN ?", languageIds).Delete(&Language{}).Error
+}
+
+// DeleteProjectsCascade soft deletes projects with their languages, mutations and mutation values
+func DeleteProjectsCascade(tx *gorm.DB, projectIds []uint) error {
+	if len(projectIds) == 0 {
+		return nil
+	}
+	mutationIds := tx.Model(&Mutation{}).Select("id").Where("project_id IN ?", projectIds)
+	if err := tx.Where("mutation_id IN (?)", mutationIds).Delete(&MutationValue{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("project_id IN ?", projectIds).Delete(&Mutation{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("project_id IN ?", projectIds).Delete(&Language{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("id IN ?", projectIds).Delete(&Project{}).Error
+}
+
+// DeleteSpaceCascade soft deletes a space with all of its projects
+func DeleteSpaceCascade(tx *gorm.DB, spaceId uint) error {
+	var projectIds []uint
+	if err := tx.Model(&Project{}).Where("space_id = ?", spaceId).Pluck("id", &projectIds).Error; err != nil {
+		return err
+	}
+	if err := DeleteProjectsCascade(tx, projectIds); err != nil {
+		return err
+	}
+	return tx.Delete(&Space{}, spaceId).Error
+}
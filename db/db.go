@@ -1,56 +1,219 @@
 package db
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/joho/godotenv"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"os"
+	"time"
 )
 
 type Project struct {
 	gorm.Model
-	Name      string `json:"name" binding:"required"`
-	SpaceID   uint   `json:"spaceId"`
-	Languages []Language
-	Mutations []Mutation
+	Name    string `json:"name" binding:"required"`
+	SpaceID uint   `json:"spaceId"`
+	// ArchivedAt marks the project as read-only and hides it from project listing
+	ArchivedAt *time.Time `json:"archivedAt"`
+	// Workflow replaces the default status workflow when it is set
+	Workflow *Workflow `gorm:"type:jsonb" json:"workflow,omitempty"`
+	// SourceLanguageID is the language translations are made from, changing its values outdates the others
+	SourceLanguageID *uint `json:"sourceLanguageId"`
+	Languages        []Language
+	Mutations        []Mutation
 }
 
 func (project *Project) ToSimpleProject() SimpleProject {
 	return SimpleProject{
-		ID:      project.ID,
-		Name:    project.Name,
-		SpaceId: project.SpaceID,
+		ID:               project.ID,
+		Name:             project.Name,
+		SpaceId:          project.SpaceID,
+		Archived:         project.ArchivedAt != nil,
+		SourceLanguageID: project.SourceLanguageID,
 	}
 }
 
 func (user *User) ToSimpleUser() SimpleUser {
 	return SimpleUser{
-		ID:       user.ID,
-		Name:     user.Name,
-		Username: user.Username,
+		ID:               user.ID,
+		Name:             user.Name,
+		Username:         user.Username,
+		TwoFactorEnabled: user.TOTPEnabled,
 	}
 }
 
 type SimpleUser struct {
-	ID       uint   `json:"id"`
-	Name     string `json:"name"`
-	Username string `json:"username"`
+	ID               uint   `json:"id"`
+	Name             string `json:"name"`
+	Username         string `json:"username"`
+	TwoFactorEnabled bool   `json:"twoFactorEnabled"`
 }
 
 type User struct {
 	gorm.Model
 	Name     string `json:"name"`
 	Username string `json:"username" gorm:"uniqueIndex"`
-	Password string
-	Spaces   []Space `gorm:"many2many:user_spaces;"`
+	Email    string `json:"email" gorm:"index"`
+	// EmailVerifiedAt is set once the user proved access to the mailbox,
+	// only verified emails link accounts to identities of the identity provider
+	EmailVerifiedAt *time.Time `json:"-"`
+	Password        string
+	// IsAdmin marks an administrator of the whole installation, it is only set directly in the database
+	IsAdmin bool `json:"-"`
+	// TOTPPendingSecret waits for the first valid code before it becomes TOTPSecret,
+	// TOTPLastStep is the time step of the last accepted code so no code is used twice
+	TOTPSecret        string  `json:"-"`
+	TOTPPendingSecret string  `json:"-"`
+	TOTPEnabled       bool    `json:"-"`
+	TOTPLastStep      int64   `json:"-"`
+	Spaces            []Space `gorm:"many2many:user_spaces;"`
+}
+
+const (
+	AuthMethodPassword = "password"
+	AuthMethodSSO      = "sso"
+)
+
+// UserIdentity links a user to the subject of an OpenID Connect issuer
+type UserIdentity struct {
+	gorm.Model
+	UserID  uint   `gorm:"index" json:"userId"`
+	Issuer  string `gorm:"uniqueIndex:idx_issuer_subject,where:deleted_at IS NULL" json:"issuer"`
+	Subject string `gorm:"uniqueIndex:idx_issuer_subject,where:deleted_at IS NULL" json:"subject"`
+	Email   string `json:"email"`
+}
+
+// RecoveryCode replaces a TOTP code once when the authenticator is lost, only its hash is stored
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint `gorm:"index"`
+	CodeHash string
+	UsedAt   *time.Time
+}
+
+// UserSpace is the membership of a user in a space together with the user's role
+type UserSpace struct {
+	UserID  uint `gorm:"primaryKey"`
+	SpaceID uint `gorm:"primaryKey"`
+	// Role defaults to the least privileged role, memberships are created with an explicit role
+	Role string `gorm:"default:viewer"`
+}
+
+// LanguagePermission restricts a member to editing only some languages of a project,
+// members without any permission rows for a project may edit all of its languages
+type LanguagePermission struct {
+	UserID     uint `gorm:"primaryKey"`
+	ProjectID  uint `gorm:"primaryKey"`
+	LanguageID uint `gorm:"primaryKey"`
+}
+
+const (
+	InvitationPending  = "PENDING"
+	InvitationAccepted = "ACCEPTED"
+	InvitationDeclined = "DECLINED"
+	InvitationRevoked  = "REVOKED"
+)
+
+// Invitation invites someone by email into a space with the intended role,
+// only the hash of the single-use token is stored
+type Invitation struct {
+	gorm.Model
+	SpaceID      uint      `json:"spaceId"`
+	Space        Space     `json:"-"`
+	Email        string    `json:"email"`
+	Role         string    `json:"role"`
+	TokenHash    string    `gorm:"uniqueIndex" json:"-"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	InvitedByID  uint      `json:"invitedById"`
+	Status       string    `json:"status"`
+	AcceptedByID *uint     `json:"acceptedById"`
+}
+
+// ApiToken authenticates CI pipelines, project tokens are limited to a single project.
+// Only the hash of the token is stored, Prefix helps to recognize it
+type ApiToken struct {
+	gorm.Model
+	Name      string `json:"name"`
+	UserID    uint   `json:"userId"`
+	ProjectID *uint  `json:"projectId"`
+	Scopes    string `json:"scopes"`
+	// AuthMethod is the login method of the session which created the token
+	AuthMethod string     `gorm:"default:password" json:"authMethod"`
+	Prefix     string     `json:"prefix"`
+	TokenHash  string     `gorm:"uniqueIndex" json:"-"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+}
+
+// Session is a login of a user on a device, the refresh token rotates on every use
+// and the previous hash is kept to detect reuse of a stolen token
+type Session struct {
+	gorm.Model
+	UserID              uint   `gorm:"index" json:"userId"`
+	RefreshTokenHash    string `gorm:"uniqueIndex" json:"-"`
+	PreviousRefreshHash string `gorm:"index" json:"-"`
+	UserAgent           string `json:"userAgent"`
+	IP                  string `json:"ip"`
+	// AuthMethod tells how the session was started, see AuthMethodPassword and AuthMethodSSO
+	AuthMethod string     `gorm:"default:password" json:"authMethod"`
+	LastSeenAt time.Time  `json:"lastSeenAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+}
+
+// PasswordReset is a single-use request to set a new password, only the token hash is stored
+type PasswordReset struct {
+	gorm.Model
+	UserID    uint   `gorm:"index"`
+	TokenHash string `gorm:"uniqueIndex"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// LoginAttempt holds the failed login counter of an account or an IP address,
+// it is the shared state of the Postgres login throttle store
+type LoginAttempt struct {
+	Key           string `gorm:"primaryKey"`
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+const (
+	LoginWrongPassword = "wrong_password"
+	LoginUnknownUser   = "unknown_user"
+	LoginThrottled     = "throttled"
+	LoginLocked        = "locked"
+	LoginWrongCode     = "wrong_code"
+	LoginUnlocked      = "unlocked"
+)
+
+// LoginAudit records failed and blocked logins and unlocks done by administrators
+type LoginAudit struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"createdAt"`
+	Username  string    `gorm:"index" json:"username"`
+	UserID    *uint     `gorm:"index" json:"userId"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	Outcome   string    `json:"outcome"`
+	// ActorID is the administrator who unlocked the account
+	ActorID *uint `json:"actorId,omitempty"`
 }
 
 type Space struct {
 	gorm.Model
-	Name     string `json:"name"`
-	Projects []Project
-	Users    []User `gorm:"many2many:user_spaces;"`
+	Name string `json:"name"`
+	// RequireTwoFactor keeps members without two-factor authentication out of the projects
+	RequireTwoFactor bool `json:"requireTwoFactor"`
+	// RequireSSO refuses password logins of the members, they have to use single sign-on
+	RequireSSO bool `json:"requireSso"`
+	Projects   []Project
+	Users      []User `gorm:"many2many:user_spaces;"`
 }
 
 func (space *Space) ToSimpleSpace() SimpleSpace {
@@ -65,52 +228,174 @@ func (space *Space) ToSimpleSpace() SimpleSpace {
 	}
 
 	return SimpleSpace{
-		ID:       space.ID,
-		Name:     space.Name,
-		Users:    users,
-		Projects: projects,
+		ID:               space.ID,
+		Name:             space.Name,
+		RequireTwoFactor: space.RequireTwoFactor,
+		RequireSSO:       space.RequireSSO,
+		Users:            users,
+		Projects:         projects,
 	}
 }
 
 type SimpleSpace struct {
-	ID       uint            `json:"id"`
-	Name     string          `json:"name"`
-	Users    []SimpleUser    `json:"users"`
-	Projects []SimpleProject `json:"projects"`
+	ID               uint            `json:"id"`
+	Name             string          `json:"name"`
+	RequireTwoFactor bool            `json:"requireTwoFactor"`
+	RequireSSO       bool            `json:"requireSso"`
+	Users            []SimpleUser    `json:"users"`
+	Projects         []SimpleProject `json:"projects"`
 }
 
 type SimpleProject struct {
-	ID      uint   `json:"id"`
-	Name    string `json:"name"`
-	SpaceId uint   `json:"spaceId"`
+	ID               uint   `json:"id"`
+	Name             string `json:"name"`
+	SpaceId          uint   `json:"spaceId"`
+	Archived         bool   `json:"archived"`
+	SourceLanguageID *uint  `json:"sourceLanguageId"`
 }
 
 type SimpleLanguage struct {
-	ID        uint   `json:"id"`
-	Name      string `json:"name"`
-	ProjectID uint   `json:"projectId"`
+	ID          uint   `json:"id"`
+	Name        string `json:"name"`
+	Code        string `json:"code"`
+	DisplayName string `json:"displayName"`
+	Direction   string `json:"direction"`
+	PluralRules string `json:"pluralRules"`
+	FallbackID  *uint  `json:"fallbackId"`
+	ProjectID   uint   `json:"projectId"`
 }
 
 func (language *Language) ToSimpleLanguage() SimpleLanguage {
 	return SimpleLanguage{
-		ID:        language.ID,
-		Name:      language.Name,
-		ProjectID: language.ProjectID,
+		ID:          language.ID,
+		Name:        language.Name,
+		Code:        language.Code,
+		DisplayName: language.DisplayName,
+		Direction:   language.Direction,
+		PluralRules: language.PluralRules,
+		FallbackID:  language.FallbackID,
+		ProjectID:   language.ProjectID,
 	}
 }
 
 type Language struct {
 	gorm.Model
-	Name           string `json:"name"`
-	ProjectID      uint   `json:"projectId"`
+	Name string `json:"name"`
+	// Code is a canonical BCP 47 language tag, unique within the project
+	Code        string `gorm:"uniqueIndex:idx_code_projectID,where:code <> '' AND deleted_at IS NULL" json:"code"`
+	DisplayName string `json:"displayName"`
+	Direction   string `json:"direction"`
+	PluralRules string `json:"pluralRules"`
+	// FallbackID points to the language used when a value is missing, fallbacks form a chain
+	FallbackID     *uint `json:"fallbackId"`
+	ProjectID      uint  `gorm:"uniqueIndex:idx_code_projectID,where:code <> '' AND deleted_at IS NULL" json:"projectId"`
 	MutationValues []MutationValue
 }
 
+// Built-in statuses of mutations and mutation values
+const (
+	StatusNeedsTranslation = "NEEDS_TRANSLATION"
+	StatusTranslated       = "TRANSLATED"
+	StatusInReview         = "IN_REVIEW"
+	StatusApproved         = "APPROVED"
+	StatusRejected         = "REJECTED"
+	StatusOutdated         = "OUTDATED"
+)
+
+// WorkflowTransition allows changing the status From to To for roles with the Permission,
+// From may be "*" to allow the transition from any status
+type WorkflowTransition struct {
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Permission string `json:"permission"`
+}
+
+// Workflow is the custom status workflow of a project, stored as jsonb.
+// States are added to the built-in statuses and Transitions replace the default ones
+type Workflow struct {
+	States      []string             `json:"states"`
+	Transitions []WorkflowTransition `json:"transitions"`
+}
+
+func (workflow Workflow) Value() (driver.Value, error) {
+	return json.Marshal(workflow)
+}
+
+func (workflow *Workflow) Scan(value interface{}) error {
+	var data []byte
+	switch typed := value.(type) {
+	case []byte:
+		data = typed
+	case string:
+		data = []byte(typed)
+	default:
+		return errors.New("cannot scan workflow")
+	}
+	return json.Unmarshal(data, workflow)
+}
+
+// PluralForms maps CLDR plural categories to their translations, stored as jsonb
+type PluralForms map[string]string
+
+func (forms PluralForms) Value() (driver.Value, error) {
+	if forms == nil {
+		return nil, nil
+	}
+	return json.Marshal(forms)
+}
+
+func (forms *PluralForms) Scan(value interface{}) error {
+	if value == nil {
+		*forms = nil
+		return nil
+	}
+	var data []byte
+	switch typed := value.(type) {
+	case []byte:
+		data = typed
+	case string:
+		data = []byte(typed)
+	default:
+		return errors.New("cannot scan plural forms")
+	}
+	return json.Unmarshal(data, forms)
+}
+
+// Tags labels a mutation, stored as a jsonb array
+type Tags []string
+
+func (tags Tags) Value() (driver.Value, error) {
+	if tags == nil {
+		return nil, nil
+	}
+	return json.Marshal(tags)
+}
+
+func (tags *Tags) Scan(value interface{}) error {
+	if value == nil {
+		*tags = nil
+		return nil
+	}
+	var data []byte
+	switch typed := value.(type) {
+	case []byte:
+		data = typed
+	case string:
+		data = []byte(typed)
+	default:
+		return errors.New("cannot scan tags")
+	}
+	return json.Unmarshal(data, tags)
+}
+
 type Mutation struct {
 	gorm.Model
-	Key            string          `gorm:"index:idx_key_projectID,unique" json:"key"`
-	ProjectID      uint            `gorm:"index:idx_key_projectID,unique" json:"projectId"`
+	// Keys are only unique among mutations which are not in the trash
+	Key            string          `gorm:"index:idx_key_projectID_active,unique,where:deleted_at IS NULL" json:"key"`
+	ProjectID      uint            `gorm:"index:idx_key_projectID_active,unique,where:deleted_at IS NULL" json:"projectId"`
 	Status         string          `json:"status"`
+	Plural         bool            `json:"plural"`
+	Tags           Tags            `gorm:"type:jsonb" json:"tags"`
 	MutationValues []MutationValue `json:"values"`
 }
 
@@ -123,16 +408,21 @@ func (mutation *Mutation) ToSimpleMutation() SimpleMutation {
 		ID:             mutation.ID,
 		Key:            mutation.Key,
 		Status:         mutation.Status,
+		Plural:         mutation.Plural,
+		Tags:           mutation.Tags,
 		MutationValues: mutationValues,
 	}
 }
 
 func (mutationValue *MutationValue) ToSimpleMutationValue() SimpleMutationValue {
 	return SimpleMutationValue{
-		ID:         mutationValue.ID,
-		Value:      mutationValue.Value,
-		Status:     mutationValue.Status,
-		LanguageID: mutationValue.LanguageId,
+		ID:             mutationValue.ID,
+		Value:          mutationValue.Value,
+		Status:         mutationValue.Status,
+		Plurals:        mutationValue.Plurals,
+		LanguageID:     mutationValue.LanguageId,
+		OldSourceValue: mutationValue.OldSourceValue,
+		NewSourceValue: mutationValue.NewSourceValue,
 	}
 }
 
@@ -140,38 +430,85 @@ type SimpleMutation struct {
 	ID             uint                  `json:"id"`
 	Key            string                `json:"key"`
 	Status         string                `json:"status"`
+	Plural         bool                  `json:"plural"`
+	Tags           Tags                  `json:"tags"`
 	MutationValues []SimpleMutationValue `json:"values"`
 }
 
 type SimpleMutationValue struct {
-	ID         uint   `json:"id"`
-	Value      string `json:"value"`
-	Status     string `json:"status"`
-	LanguageID uint   `json:"languageId"`
+	ID         uint        `json:"id"`
+	Value      string      `json:"value"`
+	Status     string      `json:"status"`
+	Plurals    PluralForms `json:"plurals,omitempty"`
+	LanguageID uint        `json:"languageId"`
+	// OldSourceValue and NewSourceValue show the source change of an OUTDATED value
+	OldSourceValue string `json:"oldSourceValue,omitempty"`
+	NewSourceValue string `json:"newSourceValue,omitempty"`
+	// Editable tells whether the requesting user may edit the value, only set in listings
+	Editable *bool `json:"editable,omitempty"`
 }
 
 func (mutation *Mutation) BeforeCreate(tx *gorm.DB) (err error) {
 	if mutation.Status == "" {
-		mutation.Status = "NEEDS_TRANSLATION"
+		mutation.Status = StatusNeedsTranslation
 	}
 	return
 }
 
 type MutationValue struct {
 	gorm.Model
-	Value      string `json:"value"`
-	MutationId uint   `json:"mutationId"`
-	LanguageId uint   `json:"languageId"`
-	Status     string `json:"status"`
+	Value      string      `json:"value"`
+	MutationId uint        `gorm:"index:idx_mutation_language" json:"mutationId"`
+	LanguageId uint        `gorm:"index:idx_mutation_language" json:"languageId"`
+	Status     string      `json:"status"`
+	Plurals    PluralForms `gorm:"type:jsonb" json:"plurals"`
+	// OldSourceValue is the source text the translation was made from and NewSourceValue
+	// the changed source text, both are only set while the value is OUTDATED
+	OldSourceValue string `json:"oldSourceValue"`
+	NewSourceValue string `json:"newSourceValue"`
+}
+
+// ClearOutdated forgets the source change once the value is no longer outdated
+func (mutationValue *MutationValue) ClearOutdated() {
+	if mutationValue.Status != StatusOutdated {
+		mutationValue.OldSourceValue = ""
+		mutationValue.NewSourceValue = ""
+	}
 }
 
 func (mutationValue *MutationValue) BeforeCreate(tx *gorm.DB) (err error) {
 	if mutationValue.Status == "" {
-		mutationValue.Status = "NEEDS_TRANSLATION"
+		mutationValue.Status = StatusNeedsTranslation
 	}
 	return
 }
 
+// Revision records a single change of a mutation or one of its values,
+// the old and new state allow reverting a value to any previous revision
+type Revision struct {
+	ID              uint        `gorm:"primarykey" json:"id"`
+	CreatedAt       time.Time   `json:"createdAt"`
+	MutationID      uint        `gorm:"index" json:"mutationId"`
+	MutationValueID *uint       `gorm:"index" json:"mutationValueId"`
+	LanguageID      *uint       `json:"languageId"`
+	UserID          uint        `json:"userId"`
+	User            User        `json:"-"`
+	Action          string      `json:"action"`
+	OldKey          string      `json:"oldKey"`
+	NewKey          string      `json:"newKey"`
+	OldStatus       string      `json:"oldStatus"`
+	NewStatus       string      `json:"newStatus"`
+	OldValue        string      `json:"oldValue"`
+	NewValue        string      `json:"newValue"`
+	OldPlurals      PluralForms `gorm:"type:jsonb" json:"oldPlurals,omitempty"`
+	NewPlurals      PluralForms `gorm:"type:jsonb" json:"newPlurals,omitempty"`
+	// The plural flag and the tags are only set on revisions of the mutation itself
+	OldPlural *bool `json:"oldPlural,omitempty"`
+	NewPlural *bool `json:"newPlural,omitempty"`
+	OldTags   Tags  `gorm:"type:jsonb" json:"oldTags,omitempty"`
+	NewTags   Tags  `gorm:"type:jsonb" json:"newTags,omitempty"`
+}
+
 var db *gorm.DB
 
 func init() {
@@ -191,10 +528,55 @@ func init() {
 		panic("Failed to connect database")
 	}
 
-	err = db.AutoMigrate(&Space{}, &Project{}, &Language{}, &Mutation{}, &MutationValue{}, &User{})
+	// Memberships created before roles existed are backfilled as owners, as every member had full access
+	backfillRoles := db.Migrator().HasTable(&UserSpace{}) && !db.Migrator().HasColumn(&UserSpace{}, "Role")
+
+	err = db.SetupJoinTable(&User{}, "Spaces", &UserSpace{})
+	if err != nil {
+		panic("Failed to setup user spaces")
+	}
+	err = db.SetupJoinTable(&Space{}, "Users", &UserSpace{})
+	if err != nil {
+		panic("Failed to setup user spaces")
+	}
+
+	err = db.AutoMigrate(&Space{}, &Project{}, &Language{}, &Mutation{}, &MutationValue{}, &User{}, &Revision{}, &LanguagePermission{}, &Invitation{}, &ApiToken{}, &Session{}, &PasswordReset{}, &LoginAttempt{}, &LoginAudit{}, &RecoveryCode{}, &UserIdentity{})
 	if err != nil {
 		panic("Failed to migrate database")
 	}
+
+	if backfillRoles {
+		if err := db.Model(&UserSpace{}).Where("1 = 1").Update("role", "owner").Error; err != nil {
+			panic("Failed to migrate database")
+		}
+	}
+
+	// The former unique index also covered soft deleted mutations,
+	// so a deleted key could never be created again
+	if db.Migrator().HasIndex(&Mutation{}, "idx_key_projectID") {
+		err = db.Migrator().DropIndex(&Mutation{}, "idx_key_projectID")
+		if err != nil {
+			panic("Failed to migrate database")
+		}
+	}
+
+	createSearchIndexes(db)
+}
+
+// createSearchIndexes adds trigram indexes so substring and case-insensitive searches
+// do not scan every value, search still works without them when pg_trgm is not available
+func createSearchIndexes(db *gorm.DB) {
+	statements := []string{
+		"CREATE EXTENSION IF NOT EXISTS pg_trgm",
+		"CREATE INDEX IF NOT EXISTS idx_mutation_values_value_trgm ON mutation_values USING gin (value gin_trgm_ops)",
+		"CREATE INDEX IF NOT EXISTS idx_mutations_key_trgm ON mutations USING gin (key gin_trgm_ops)",
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			fmt.Println("Could not create search indexes, searches will be slower:", err)
+			return
+		}
+	}
 }
 
 func GetDb() *gorm.DB {
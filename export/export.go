@@ -1,9 +1,13 @@
 package export
 
 import (
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"languageboostergo/auth"
 	"languageboostergo/db"
+	"languageboostergo/keys"
+	"languageboostergo/languages"
+	"languageboostergo/locales"
 	"net/http"
 	"strings"
 )
@@ -12,7 +16,40 @@ var conn = db.GetDb()
 
 type ByProjectAndLanguageDto struct {
 	ProjectID  uint `json:"projectId" binding:"required"`
-	LanguageID uint `json:"languageId" binding:"required"`
+	LanguageID uint `json:"languageId"`
+	// LanguageCode addresses the language by its BCP 47 code instead of its ID
+	LanguageCode string `json:"languageCode"`
+	Format       string `json:"format"`
+	// Fallback fills missing values from the language's fallback chain
+	Fallback bool `json:"fallback"`
+	// Report wraps the exported file into JSON together with the keys filled from fallbacks
+	Report bool `json:"report"`
+}
+
+// findLanguage resolves the requested language of the project by ID or by code
+func findLanguage(request ByProjectAndLanguageDto) (db.Language, error) {
+	var language db.Language
+	query := conn.Where("project_id = ?", request.ProjectID)
+	if request.LanguageID != 0 {
+		query = query.Where("id = ?", request.LanguageID)
+	} else {
+		code, err := locales.Normalize(request.LanguageCode)
+		if err != nil {
+			return language, err
+		}
+		query = query.Where("code = ?", code)
+	}
+	err := query.First(&language).Error
+	return language, err
+}
+
+// exportFileName names the exported file by the language code, e.g. "de-DE.json"
+func exportFileName(language db.Language, exporter Exporter) string {
+	name := language.Code
+	if name == "" {
+		name = fmt.Sprintf("language-%d", language.ID)
+	}
+	return name + "." + exporter.Extension()
 }
 
 func toExportKey(data []db.Mutation) map[string]interface{} {
@@ -26,7 +63,7 @@ func toExportKey(data []db.Mutation) map[string]interface{} {
 				// If our index is the end of the keys list,
 				// We should assign the value instead of declaring a new map
 				if mutationValuesLen > 0 {
-					tempObj[key] = current.MutationValues[0].Value
+					tempObj[key] = mutationValue(current)
 				} else {
 					tempObj[key] = ""
 				}
@@ -39,8 +76,13 @@ func toExportKey(data []db.Mutation) map[string]interface{} {
 				}
 
 				// Before proceeding to the next key,
-				// We type assert tempObj[key] as a map[string]interface{}
-				tempObj = tempObj[key].(map[string]interface{})
+				// We type assert tempObj[key] as a map[string]interface{},
+				// a colliding leaf key cannot be nested into, so the key is skipped
+				nested, ok := tempObj[key].(map[string]interface{})
+				if !ok {
+					break
+				}
+				tempObj = nested
 			}
 		}
 	}
@@ -56,12 +98,71 @@ func ByProjectIdAndLanguageId(c *gin.Context) {
 
 	userId := c.MustGet("userId").(uint)
 
-	if !auth.IsUserInProject(userId, request.ProjectID) {
+	if !auth.RequestAllowsProject(c, request.ProjectID) || !auth.IsUserInProject(userId, request.ProjectID) {
 		c.JSON(403, "You are not in this project")
 		return
 	}
 
+	if request.Format == "" {
+		request.Format = "json"
+	}
+
+	exporter, ok := GetExporter(request.Format)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Unknown export format", "formats": Formats()})
+		return
+	}
+
+	if request.LanguageID == 0 && request.LanguageCode == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Either languageId or languageCode is required"})
+		return
+	}
+
+	language, err := findLanguage(request)
+	if err != nil {
+		c.JSON(404, "Language does not exist in this project")
+		return
+	}
+
+	var chain []db.Language
+	languageIds := []uint{language.ID}
+	if request.Fallback {
+		chain = languages.FallbackChain(language)
+		for _, fallback := range chain {
+			languageIds = append(languageIds, fallback.ID)
+		}
+	}
+
 	var mutations []db.Mutation
-	conn.Preload("MutationValues", "language_id = ?", request.LanguageID).Order("key asc").Find(&mutations, "mutations.project_id = ?", request.ProjectID)
-	c.JSON(200, toExportKey(mutations))
+	conn.Preload("MutationValues", "language_id IN ?", languageIds).Order("key asc").Find(&mutations, "mutations.project_id = ?", request.ProjectID)
+	filled := applyFallbacks(language, chain, mutations)
+
+	if _, nested := exporter.(NestedExporter); nested {
+		mutationKeys := make([]string, len(mutations))
+		for i, mutation := range mutations {
+			mutationKeys[i] = mutation.Key
+		}
+		if collisions := keys.FindCollisions(mutationKeys); len(collisions) > 0 {
+			c.JSON(409, gin.H{"message": "Project contains colliding keys", "collisions": collisions})
+			return
+		}
+	}
+
+	data, err := exporter.Export(language, mutations)
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error exporting mutations", "error": err.Error()})
+		return
+	}
+
+	if request.Report {
+		c.JSON(200, gin.H{
+			"fileName": exportFileName(language, exporter),
+			"content":  string(data),
+			"filled":   filled,
+		})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFileName(language, exporter)))
+	c.Data(200, exporter.ContentType(), data)
 }
@@ -0,0 +1,338 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"languageboostergo/db"
+	"languageboostergo/keys"
+	"languageboostergo/plurals"
+	"sort"
+	"strings"
+)
+
+// Exporter serializes the mutations of a single language into a file format,
+// mutations are expected to have preloaded only the values of that language
+type Exporter interface {
+	Export(language db.Language, mutations []db.Mutation) ([]byte, error)
+	ContentType() string
+	Extension() string
+}
+
+// NestedExporter is implemented by exporters which nest dotted keys into objects,
+// these cannot represent a key which is also a namespace of another key
+type NestedExporter interface {
+	Nested()
+}
+
+var exporters = make(map[string]Exporter)
+
+// RegisterExporter makes an exporter available under the given format name
+func RegisterExporter(format string, exporter Exporter) {
+	exporters[format] = exporter
+}
+
+func GetExporter(format string) (Exporter, bool) {
+	exporter, ok := exporters[format]
+	return exporter, ok
+}
+
+func Formats() []string {
+	formats := make([]string, 0, len(exporters))
+	for format := range exporters {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+func init() {
+	RegisterExporter("json", jsonExporter{})
+	RegisterExporter("json-flat", flatJsonExporter{})
+	RegisterExporter("yaml", yamlExporter{})
+	RegisterExporter("android", androidExporter{})
+	RegisterExporter("ios", iosExporter{})
+	RegisterExporter("stringsdict", stringsdictExporter{})
+	RegisterExporter("po", poExporter{})
+	RegisterExporter("properties", propertiesExporter{})
+}
+
+// pluralForms returns the plural forms of a plural mutation's preloaded value
+func pluralForms(mutation db.Mutation) (db.PluralForms, bool) {
+	if !mutation.Plural || len(mutation.MutationValues) == 0 || len(mutation.MutationValues[0].Plurals) == 0 {
+		return nil, false
+	}
+	return mutation.MutationValues[0].Plurals, true
+}
+
+// icuEscaper quotes the characters with a meaning in ICU MessageFormat, # is kept
+// as translators use it for the number
+var icuEscaper = strings.NewReplacer("'", "''", "{", "'{'", "}", "'}'")
+
+// toICUPlural renders plural forms as an ICU MessageFormat plural argument
+func toICUPlural(forms db.PluralForms) string {
+	var buf strings.Builder
+	buf.WriteString("{count, plural,")
+	for _, category := range plurals.AllCategories {
+		if form, ok := forms[category]; ok {
+			fmt.Fprintf(&buf, " %s {%s}", category, icuEscaper.Replace(form))
+		}
+	}
+	buf.WriteString("}")
+	return buf.String()
+}
+
+// mutationValue returns the value of the first preloaded mutation value,
+// export always preloads only values of the requested language,
+// plural values are rendered as ICU messages
+func mutationValue(mutation db.Mutation) string {
+	if forms, ok := pluralForms(mutation); ok {
+		return toICUPlural(forms)
+	}
+	if len(mutation.MutationValues) > 0 {
+		return mutation.MutationValues[0].Value
+	}
+	return ""
+}
+
+type jsonExporter struct{}
+
+func (jsonExporter) Export(language db.Language, mutations []db.Mutation) ([]byte, error) {
+	return json.MarshalIndent(toExportKey(mutations), "", "  ")
+}
+
+func (jsonExporter) ContentType() string { return "application/json; charset=utf-8" }
+func (jsonExporter) Extension() string   { return "json" }
+func (jsonExporter) Nested()             {}
+
+type flatJsonExporter struct{}
+
+func (flatJsonExporter) Export(language db.Language, mutations []db.Mutation) ([]byte, error) {
+	flat := make(map[string]string, len(mutations))
+	for _, mutation := range mutations {
+		flat[mutation.Key] = mutationValue(mutation)
+	}
+	return json.MarshalIndent(flat, "", "  ")
+}
+
+func (flatJsonExporter) ContentType() string { return "application/json; charset=utf-8" }
+func (flatJsonExporter) Extension() string   { return "json" }
+
+type yamlExporter struct{}
+
+func (yamlExporter) Export(language db.Language, mutations []db.Mutation) ([]byte, error) {
+	return yaml.Marshal(toExportKey(mutations))
+}
+
+func (yamlExporter) ContentType() string { return "application/yaml; charset=utf-8" }
+func (yamlExporter) Extension() string   { return "yaml" }
+func (yamlExporter) Nested()             {}
+
+type androidExporter struct{}
+
+func escapeAndroid(value string) string {
+	var buf strings.Builder
+	for i, r := range value {
+		switch r {
+		case '&':
+			buf.WriteString("&amp;")
+		case '<':
+			buf.WriteString("&lt;")
+		case '>':
+			buf.WriteString("&gt;")
+		case '\'':
+			buf.WriteString("\\'")
+		case '"':
+			buf.WriteString("\\\"")
+		case '\\':
+			buf.WriteString("\\\\")
+		case '\n':
+			buf.WriteString("\\n")
+		case '\t':
+			buf.WriteString("\\t")
+		case '@', '?':
+			// Leading @ and ? are resource references for aapt
+			if i == 0 {
+				buf.WriteRune('\\')
+			}
+			buf.WriteRune(r)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+func (androidExporter) Export(language db.Language, mutations []db.Mutation) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<resources>\n")
+	for _, mutation := range mutations {
+		name := keys.AndroidResourceName(mutation.Key)
+		if forms, ok := pluralForms(mutation); ok {
+			fmt.Fprintf(&buf, "    <plurals name=\"%s\">\n", name)
+			for _, category := range plurals.AllCategories {
+				if form, ok := forms[category]; ok {
+					fmt.Fprintf(&buf, "        <item quantity=\"%s\">%s</item>\n", category, escapeAndroid(form))
+				}
+			}
+			buf.WriteString("    </plurals>\n")
+			continue
+		}
+		fmt.Fprintf(&buf, "    <string name=\"%s\">%s</string>\n", name, escapeAndroid(mutationValue(mutation)))
+	}
+	buf.WriteString("</resources>\n")
+	return buf.Bytes(), nil
+}
+
+func (androidExporter) ContentType() string { return "application/xml; charset=utf-8" }
+func (androidExporter) Extension() string   { return "xml" }
+
+// escapeCString escapes a value for double-quoted string literals
+// used by both iOS .strings and gettext files
+func escapeCString(value string) string {
+	replacer := strings.NewReplacer(
+		"\\", "\\\\",
+		"\"", "\\\"",
+		"\n", "\\n",
+		"\r", "\\r",
+		"\t", "\\t",
+	)
+	return replacer.Replace(value)
+}
+
+type iosExporter struct{}
+
+func (iosExporter) Export(language db.Language, mutations []db.Mutation) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, mutation := range mutations {
+		// Plural mutations are exported into the .stringsdict file
+		if _, ok := pluralForms(mutation); ok {
+			continue
+		}
+		fmt.Fprintf(&buf, "\"%s\" = \"%s\";\n", escapeCString(mutation.Key), escapeCString(mutationValue(mutation)))
+	}
+	return buf.Bytes(), nil
+}
+
+func (iosExporter) ContentType() string { return "text/plain; charset=utf-8" }
+func (iosExporter) Extension() string   { return "strings" }
+
+type stringsdictExporter struct{}
+
+func escapeXml(value string) string {
+	var buf bytes.Buffer
+	_ = xml.EscapeText(&buf, []byte(value))
+	return buf.String()
+}
+
+func (stringsdictExporter) Export(language db.Language, mutations []db.Mutation) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	buf.WriteString("<!DOCTYPE plist PUBLIC \"-//Apple//DTD PLIST 1.0//EN\" \"http://www.apple.com/DTDs/PropertyList-1.0.dtd\">\n")
+	buf.WriteString("<plist version=\"1.0\">\n<dict>\n")
+	for _, mutation := range mutations {
+		forms, ok := pluralForms(mutation)
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&buf, "    <key>%s</key>\n    <dict>\n", escapeXml(mutation.Key))
+		buf.WriteString("        <key>NSStringLocalizedFormatKey</key>\n        <string>%#@count@</string>\n")
+		buf.WriteString("        <key>count</key>\n        <dict>\n")
+		buf.WriteString("            <key>NSStringFormatSpecTypeKey</key>\n            <string>NSStringPluralRuleType</string>\n")
+		buf.WriteString("            <key>NSStringFormatValueTypeKey</key>\n            <string>d</string>\n")
+		for _, category := range plurals.AllCategories {
+			if form, ok := forms[category]; ok {
+				fmt.Fprintf(&buf, "            <key>%s</key>\n            <string>%s</string>\n", category, escapeXml(form))
+			}
+		}
+		buf.WriteString("        </dict>\n    </dict>\n")
+	}
+	buf.WriteString("</dict>\n</plist>\n")
+	return buf.Bytes(), nil
+}
+
+func (stringsdictExporter) ContentType() string { return "application/xml; charset=utf-8" }
+func (stringsdictExporter) Extension() string   { return "stringsdict" }
+
+type poExporter struct{}
+
+func (poExporter) Export(language db.Language, mutations []db.Mutation) ([]byte, error) {
+	var buf bytes.Buffer
+	ruleSet := plurals.ForLanguage(language.PluralRules, language.Code)
+	buf.WriteString("msgid \"\"\nmsgstr \"\"\n\"Content-Type: text/plain; charset=UTF-8\\n\"\n")
+	if language.Code != "" {
+		fmt.Fprintf(&buf, "\"Language: %s\\n\"\n", escapeCString(language.Code))
+	}
+	fmt.Fprintf(&buf, "\"Plural-Forms: %s\\n\"\n", ruleSet.GettextRule)
+	for _, mutation := range mutations {
+		key := escapeCString(mutation.Key)
+		if forms, ok := pluralForms(mutation); ok {
+			fmt.Fprintf(&buf, "\nmsgid \"%s\"\nmsgid_plural \"%s\"\n", key, key)
+			for index, category := range ruleSet.GettextForms {
+				fmt.Fprintf(&buf, "msgstr[%d] \"%s\"\n", index, escapeCString(forms[category]))
+			}
+			continue
+		}
+		fmt.Fprintf(&buf, "\nmsgid \"%s\"\nmsgstr \"%s\"\n", key, escapeCString(mutationValue(mutation)))
+	}
+	return buf.Bytes(), nil
+}
+
+func (poExporter) ContentType() string { return "text/x-gettext-translation; charset=utf-8" }
+func (poExporter) Extension() string   { return "po" }
+
+type propertiesExporter struct{}
+
+// escapeProperties escapes a key or value for .properties files,
+// non ASCII characters are written as unicode escapes so the output is valid ISO-8859-1
+func escapeProperties(value string, isKey bool) string {
+	var buf strings.Builder
+	for i, r := range value {
+		switch {
+		case r == '\\':
+			buf.WriteString("\\\\")
+		case r == '\n':
+			buf.WriteString("\\n")
+		case r == '\r':
+			buf.WriteString("\\r")
+		case r == '\t':
+			buf.WriteString("\\t")
+		case r == '\f':
+			buf.WriteString("\\f")
+		case r == '=' || r == ':' || r == '#' || r == '!':
+			buf.WriteRune('\\')
+			buf.WriteRune(r)
+		case r == ' ' && (isKey || i == 0):
+			buf.WriteString("\\ ")
+		case r > 0x7e || r < 0x20:
+			if r > 0xffff {
+				for _, unit := range utf16Units(r) {
+					fmt.Fprintf(&buf, "\\u%04x", unit)
+				}
+			} else {
+				fmt.Fprintf(&buf, "\\u%04x", r)
+			}
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+func utf16Units(r rune) []rune {
+	r -= 0x10000
+	return []rune{0xd800 + (r>>10)&0x3ff, 0xdc00 + r&0x3ff}
+}
+
+func (propertiesExporter) Export(language db.Language, mutations []db.Mutation) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, mutation := range mutations {
+		fmt.Fprintf(&buf, "%s=%s\n", escapeProperties(mutation.Key, true), escapeProperties(mutationValue(mutation), false))
+	}
+	return buf.Bytes(), nil
+}
+
+func (propertiesExporter) ContentType() string { return "text/plain; charset=iso-8859-1" }
+func (propertiesExporter) Extension() string   { return "properties" }
@@ -0,0 +1,54 @@
+package export
+
+import (
+	"languageboostergo/db"
+)
+
+// FilledValue reports a key whose value was taken from a fallback language
+type FilledValue struct {
+	Key          string `json:"key"`
+	LanguageID   uint   `json:"languageId"`
+	LanguageCode string `json:"languageCode"`
+}
+
+func isMissing(value db.MutationValue) bool {
+	return (value.Value == "" && len(value.Plurals) == 0) || value.Status == db.StatusNeedsTranslation
+}
+
+// applyFallbacks replaces missing values of the language by the first usable value
+// along the fallback chain, mutations have to be preloaded with values of the whole chain.
+// Afterwards every mutation holds only the single value which should be exported
+func applyFallbacks(language db.Language, chain []db.Language, mutations []db.Mutation) []FilledValue {
+	filled := []FilledValue{}
+	for i, mutation := range mutations {
+		valuesByLanguage := make(map[uint]db.MutationValue, len(mutation.MutationValues))
+		for _, value := range mutation.MutationValues {
+			valuesByLanguage[value.LanguageId] = value
+		}
+
+		value, exists := valuesByLanguage[language.ID]
+		if !exists || isMissing(value) {
+			for _, fallback := range chain {
+				fallbackValue, ok := valuesByLanguage[fallback.ID]
+				if !ok || isMissing(fallbackValue) {
+					continue
+				}
+				value = fallbackValue
+				exists = true
+				filled = append(filled, FilledValue{
+					Key:          mutation.Key,
+					LanguageID:   fallback.ID,
+					LanguageCode: fallback.Code,
+				})
+				break
+			}
+		}
+
+		if exists {
+			mutations[i].MutationValues = []db.MutationValue{value}
+		} else {
+			mutations[i].MutationValues = nil
+		}
+	}
+	return filled
+}
@@ -0,0 +1,95 @@
+package history
+
+import (
+	"gorm.io/gorm"
+	"languageboostergo/db"
+)
+
+const (
+	ActionCreate  = "create"
+	ActionUpdate  = "update"
+	ActionDelete  = "delete"
+	ActionRestore = "restore"
+	ActionRevert  = "revert"
+)
+
+// RecordMutation stores a change of the mutation's key, status, plural flag or tags,
+// old is nil when the mutation was just created
+func RecordMutation(tx *gorm.DB, userId uint, action string, old *db.Mutation, new db.Mutation) error {
+	newPlural := new.Plural
+	revision := db.Revision{
+		MutationID: new.ID,
+		UserID:     userId,
+		Action:     action,
+		NewKey:     new.Key,
+		NewStatus:  new.Status,
+		NewPlural:  &newPlural,
+		NewTags:    new.Tags,
+	}
+	if old != nil {
+		if action == ActionUpdate && old.Key == new.Key && old.Status == new.Status && old.Plural == new.Plural && SameTags(old.Tags, new.Tags) {
+			return nil
+		}
+		oldPlural := old.Plural
+		revision.OldKey = old.Key
+		revision.OldStatus = old.Status
+		revision.OldPlural = &oldPlural
+		revision.OldTags = old.Tags
+	}
+	return tx.Create(&revision).Error
+}
+
+// RecordMutationValue stores a change of a mutation value,
+// old is nil when the value was just created
+func RecordMutationValue(tx *gorm.DB, userId uint, action string, old *db.MutationValue, new db.MutationValue) error {
+	revision := db.Revision{
+		MutationID:      new.MutationId,
+		MutationValueID: &new.ID,
+		LanguageID:      &new.LanguageId,
+		UserID:          userId,
+		Action:          action,
+		NewValue:        new.Value,
+		NewStatus:       new.Status,
+		NewPlurals:      new.Plurals,
+	}
+	if old != nil {
+		if action == ActionUpdate && old.Value == new.Value && old.Status == new.Status && SamePlurals(old.Plurals, new.Plurals) {
+			return nil
+		}
+		revision.OldValue = old.Value
+		revision.OldStatus = old.Status
+		revision.OldPlurals = old.Plurals
+	}
+	return tx.Create(&revision).Error
+}
+
+// SameTags compares tags regardless of their order
+func SameTags(a, b db.Tags) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int, len(a))
+	for _, tag := range a {
+		counts[tag]++
+	}
+	for _, tag := range b {
+		if counts[tag] == 0 {
+			return false
+		}
+		counts[tag]--
+	}
+	return true
+}
+
+// SamePlurals compares plural forms regardless of their order
+func SamePlurals(a, b db.PluralForms) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for category, form := range a {
+		if other, ok := b[category]; !ok || other != form {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,344 @@
+package imports
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"io"
+	"languageboostergo/auth"
+	"languageboostergo/db"
+	"languageboostergo/history"
+	"languageboostergo/keys"
+	"languageboostergo/workflow"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+)
+
+var conn = db.GetDb()
+
+const (
+	StrategyKeep      = "keep"
+	StrategyOverwrite = "overwrite"
+	StrategyFillEmpty = "fill-empty"
+)
+
+const defaultMaxImportMB = 10
+
+// maxImportSize is read from IMPORT_MAX_SIZE_MB and limits the whole upload request
+func maxImportSize() int64 {
+	megabytes, err := strconv.Atoi(os.Getenv("IMPORT_MAX_SIZE_MB"))
+	if err != nil || megabytes <= 0 {
+		megabytes = defaultMaxImportMB
+	}
+	return int64(megabytes) << 20
+}
+
+// tooLarge answers 413 when reading the upload hit the size limit
+func tooLarge(c *gin.Context, err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(err, &maxBytesErr) {
+		return false
+	}
+	c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": "The file is too large", "maxBytes": maxBytesErr.Limit})
+	return true
+}
+
+type IntoLanguageDto struct {
+	ProjectID  uint   `form:"projectId" binding:"required"`
+	LanguageID uint   `form:"languageId" binding:"required"`
+	Format     string `form:"format" binding:"required"`
+	Strategy   string `form:"strategy"`
+	// Status of the imported values, TRANSLATED by default
+	Status string `form:"status"`
+	DryRun bool   `form:"dryRun"`
+}
+
+type ImportChange struct {
+	Key      string `json:"key"`
+	OldValue string `json:"oldValue"`
+	NewValue string `json:"newValue"`
+}
+
+type ImportSummary struct {
+	DryRun  bool           `json:"dryRun"`
+	Added   []string       `json:"added"`
+	Changed []ImportChange `json:"changed"`
+	Skipped []string       `json:"skipped"`
+}
+
+// shouldWrite decides by the conflict strategy whether an existing value gets replaced
+func shouldWrite(strategy string, existing string) bool {
+	switch strategy {
+	case StrategyOverwrite:
+		return true
+	case StrategyFillEmpty:
+		return existing == ""
+	default:
+		return false
+	}
+}
+
+// IntoLanguage imports a translation file into the language of a project,
+// missing mutations are created and values of the language are upserted
+func IntoLanguage(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize())
+
+	var request IntoLanguageDto
+	if err := c.ShouldBind(&request); err != nil {
+		if !tooLarge(c, err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	userId := c.MustGet("userId").(uint)
+
+	if !auth.RequestAllowsProject(c, request.ProjectID) || !auth.CanInProject(userId, request.ProjectID, auth.PermissionKeysWrite) {
+		c.JSON(403, "You are not allowed to edit keys in this project")
+		return
+	}
+
+	if !auth.GetLanguageAccess(userId, request.ProjectID).IsLanguageAllowed(request.LanguageID) {
+		c.JSON(403, "You are not allowed to edit this language")
+		return
+	}
+
+	if auth.IsProjectArchived(request.ProjectID) {
+		c.JSON(403, "This project is archived and read-only")
+		return
+	}
+
+	if request.Strategy == "" {
+		request.Strategy = StrategyKeep
+	}
+	if request.Strategy != StrategyKeep && request.Strategy != StrategyOverwrite && request.Strategy != StrategyFillEmpty {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Unknown conflict strategy"})
+		return
+	}
+
+	// Imported text is a translation, leaving it as needs translation would hide it behind fallbacks
+	if request.Status == "" {
+		request.Status = db.StatusTranslated
+	}
+	if request.Status == db.StatusNeedsTranslation {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Imported values cannot be " + db.StatusNeedsTranslation})
+		return
+	}
+	role, _ := auth.ProjectRole(userId, request.ProjectID)
+	projectWorkflow := workflow.ForProject(request.ProjectID)
+	if err := projectWorkflow.CheckInitial(role, request.Status); err != nil {
+		c.JSON(workflow.StatusCode(err), gin.H{"message": workflow.Error(err, projectWorkflow.Initial, request.Status)})
+		return
+	}
+
+	parser, ok := GetParser(request.Format)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Unknown import format", "formats": Formats()})
+		return
+	}
+
+	var language db.Language
+	err := conn.Where("id = ? AND project_id = ?", request.LanguageID, request.ProjectID).First(&language).Error
+	if err != nil {
+		c.JSON(404, "Language does not exist in this project")
+		return
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		if !tooLarge(c, err) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "File is missing"})
+		}
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Cannot open file"})
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Cannot read file"})
+		return
+	}
+
+	values, err := parser.Parse(data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Cannot parse file", "error": err.Error()})
+		return
+	}
+
+	var projectKeys []string
+	conn.Model(&db.Mutation{}).Where("project_id = ?", request.ProjectID).Pluck("key", &projectKeys)
+
+	if resolver, ok := parser.(KeyResolver); ok {
+		values, err = resolver.ResolveKeys(values, projectKeys)
+		if err != nil {
+			c.JSON(409, gin.H{"message": "Cannot map imported names to keys", "error": err.Error()})
+			return
+		}
+	}
+	existingKeys := make(map[string]bool, len(projectKeys))
+	for _, key := range projectKeys {
+		existingKeys[key] = true
+	}
+	for key := range values {
+		if !existingKeys[key] {
+			projectKeys = append(projectKeys, key)
+		}
+	}
+	if collisions := keys.FindCollisions(projectKeys); len(collisions) > 0 {
+		c.JSON(409, gin.H{"message": "Imported keys collide with existing keys", "collisions": collisions})
+		return
+	}
+
+	summary := ImportSummary{
+		DryRun:  request.DryRun,
+		Added:   []string{},
+		Changed: []ImportChange{},
+		Skipped: []string{},
+	}
+
+	err = conn.Transaction(func(tx *gorm.DB) error {
+		summary, err = importValues(tx, userId, role, projectWorkflow, request, values, summary)
+		if err != nil {
+			return err
+		}
+		if request.DryRun {
+			return errDryRun
+		}
+		return nil
+	})
+
+	if err != nil && err != errDryRun {
+		c.JSON(500, gin.H{"message": "Error importing file", "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, summary)
+}
+
+// errDryRun rolls back the import transaction once the summary is computed
+var errDryRun = errors.New("dry run")
+
+func importValues(tx *gorm.DB, userId uint, role string, projectWorkflow workflow.Workflow, request IntoLanguageDto, values map[string]string, summary ImportSummary) (ImportSummary, error) {
+	var existingMutations []db.Mutation
+	err := tx.Preload("MutationValues", "language_id = ?", request.LanguageID).
+		Where("project_id = ?", request.ProjectID).
+		Find(&existingMutations).Error
+	if err != nil {
+		return summary, err
+	}
+
+	mutationsByKey := make(map[string]db.Mutation, len(existingMutations))
+	for _, mutation := range existingMutations {
+		mutationsByKey[mutation.Key] = mutation
+	}
+
+	var languages []db.Language
+	if err := tx.Where("project_id = ?", request.ProjectID).Find(&languages).Error; err != nil {
+		return summary, err
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := values[key]
+		mutation, exists := mutationsByKey[key]
+
+		if !exists {
+			// Mutation does not exist yet, create it with values for every language
+			mutationValues := make([]db.MutationValue, len(languages))
+			for i, language := range languages {
+				mutationValues[i] = db.MutationValue{LanguageId: language.ID}
+				if language.ID == request.LanguageID && value != "" {
+					mutationValues[i].Value = value
+					mutationValues[i].Status = request.Status
+				}
+			}
+			newMutation := db.Mutation{
+				ProjectID:      request.ProjectID,
+				Key:            key,
+				MutationValues: mutationValues,
+			}
+			if err := tx.Create(&newMutation).Error; err != nil {
+				return summary, err
+			}
+			if err := history.RecordMutation(tx, userId, history.ActionCreate, nil, newMutation); err != nil {
+				return summary, err
+			}
+			for _, newValue := range newMutation.MutationValues {
+				if err := history.RecordMutationValue(tx, userId, history.ActionCreate, nil, newValue); err != nil {
+					return summary, err
+				}
+			}
+			summary.Added = append(summary.Added, key)
+			continue
+		}
+
+		// Files are imported as plain values, which cannot fill the forms of plural mutations
+		if mutation.Plural {
+			summary.Skipped = append(summary.Skipped, key)
+			continue
+		}
+
+		if len(mutation.MutationValues) == 0 {
+			newValue := db.MutationValue{
+				MutationId: mutation.ID,
+				LanguageId: request.LanguageID,
+				Value:      value,
+			}
+			if value != "" {
+				newValue.Status = request.Status
+			}
+			if err := tx.Create(&newValue).Error; err != nil {
+				return summary, err
+			}
+			if err := history.RecordMutationValue(tx, userId, history.ActionCreate, nil, newValue); err != nil {
+				return summary, err
+			}
+			summary.Changed = append(summary.Changed, ImportChange{Key: key, NewValue: value})
+			continue
+		}
+
+		existingValue := mutation.MutationValues[0]
+		if existingValue.Value == value || !shouldWrite(request.Strategy, existingValue.Value) {
+			summary.Skipped = append(summary.Skipped, key)
+			continue
+		}
+
+		// Values the workflow does not let the role move to the imported status are skipped
+		status := request.Status
+		if value == "" {
+			status = db.StatusNeedsTranslation
+		}
+		if err := projectWorkflow.Check(role, existingValue.Status, status); err != nil {
+			summary.Skipped = append(summary.Skipped, key)
+			continue
+		}
+
+		oldValue := existingValue
+		if err := tx.Model(&existingValue).Updates(map[string]interface{}{"value": value, "status": status}).Error; err != nil {
+			return summary, err
+		}
+		existingValue.Value = value
+		existingValue.Status = status
+		if err := history.RecordMutationValue(tx, userId, history.ActionUpdate, &oldValue, existingValue); err != nil {
+			return summary, err
+		}
+		if err := workflow.MarkOutdated(tx, userId, oldValue, existingValue); err != nil {
+			return summary, err
+		}
+		summary.Changed = append(summary.Changed, ImportChange{Key: key, OldValue: oldValue.Value, NewValue: value})
+	}
+
+	return summary, nil
+}
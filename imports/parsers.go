@@ -0,0 +1,361 @@
+package imports
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"languageboostergo/keys"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Parser reads a translation file into a flat map of dotted keys to values
+type Parser interface {
+	Parse(data []byte) (map[string]string, error)
+}
+
+// KeyResolver is implemented by parsers of formats which cannot keep dotted keys,
+// it maps the names read from the file back to the keys of the project
+type KeyResolver interface {
+	ResolveKeys(values map[string]string, projectKeys []string) (map[string]string, error)
+}
+
+var parsers = make(map[string]Parser)
+
+// RegisterParser makes a parser available under the given format name
+func RegisterParser(format string, parser Parser) {
+	parsers[format] = parser
+}
+
+func GetParser(format string) (Parser, bool) {
+	parser, ok := parsers[format]
+	return parser, ok
+}
+
+func Formats() []string {
+	formats := make([]string, 0, len(parsers))
+	for format := range parsers {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+func init() {
+	RegisterParser("json", jsonParser{})
+	RegisterParser("yaml", yamlParser{})
+	RegisterParser("po", poParser{})
+	RegisterParser("ios", iosParser{})
+	RegisterParser("android", androidParser{})
+}
+
+// flatten is the inverse of the export key nesting,
+// nested objects are joined into dotted keys, already flat keys are kept as they are
+func flatten(prefix string, value interface{}, acc map[string]string) {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "." + key
+	}
+
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, nested := range typed {
+			flatten(join(key), nested, acc)
+		}
+	case map[interface{}]interface{}:
+		for key, nested := range typed {
+			flatten(join(fmt.Sprint(key)), nested, acc)
+		}
+	case []interface{}:
+		for index, nested := range typed {
+			flatten(join(strconv.Itoa(index)), nested, acc)
+		}
+	case nil:
+		acc[prefix] = ""
+	case string:
+		acc[prefix] = typed
+	default:
+		acc[prefix] = fmt.Sprint(typed)
+	}
+}
+
+type jsonParser struct{}
+
+func (jsonParser) Parse(data []byte) (map[string]string, error) {
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return nil, err
+	}
+	acc := make(map[string]string)
+	flatten("", parsed, acc)
+	return acc, nil
+}
+
+type yamlParser struct{}
+
+func (yamlParser) Parse(data []byte) (map[string]string, error) {
+	var parsed map[string]interface{}
+	if err := yaml.Unmarshal(data, &parsed); err != nil {
+		return nil, err
+	}
+	acc := make(map[string]string)
+	flatten("", parsed, acc)
+	return acc, nil
+}
+
+// unescapeCString reverses the escaping of double-quoted string literals
+// used by both iOS .strings and gettext files
+func unescapeCString(value string) string {
+	var buf strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i == len(value)-1 {
+			buf.WriteByte(value[i])
+			continue
+		}
+		i++
+		switch value[i] {
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 't':
+			buf.WriteByte('\t')
+		default:
+			buf.WriteByte(value[i])
+		}
+	}
+	return buf.String()
+}
+
+// quoted returns the content of a double-quoted literal at the start of line
+func quoted(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if len(line) < 2 || line[0] != '"' || line[len(line)-1] != '"' {
+		return "", false
+	}
+	return unescapeCString(line[1 : len(line)-1]), true
+}
+
+type poParser struct{}
+
+func (poParser) Parse(data []byte) (map[string]string, error) {
+	acc := make(map[string]string)
+	var msgid, msgstr strings.Builder
+	var current *strings.Builder
+	hasEntry := false
+
+	flush := func() {
+		if hasEntry && msgid.Len() > 0 {
+			acc[msgid.String()] = msgstr.String()
+		}
+		msgid.Reset()
+		msgstr.Reset()
+		current = nil
+		hasEntry = false
+	}
+
+	for number, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "msgctxt "):
+			flush()
+		case strings.HasPrefix(line, "msgid "):
+			flush()
+			value, ok := quoted(strings.TrimPrefix(line, "msgid "))
+			if !ok {
+				return nil, fmt.Errorf("line %d: invalid msgid", number+1)
+			}
+			msgid.WriteString(value)
+			current = &msgid
+		case strings.HasPrefix(line, "msgid_plural "):
+			current = nil
+		case strings.HasPrefix(line, "msgstr ") || strings.HasPrefix(line, "msgstr[0] "):
+			rest := strings.TrimPrefix(strings.TrimPrefix(line, "msgstr[0] "), "msgstr ")
+			value, ok := quoted(rest)
+			if !ok {
+				return nil, fmt.Errorf("line %d: invalid msgstr", number+1)
+			}
+			msgstr.WriteString(value)
+			current = &msgstr
+			hasEntry = true
+		case strings.HasPrefix(line, "msgstr["):
+			current = nil
+		case strings.HasPrefix(line, "\""):
+			value, ok := quoted(line)
+			if !ok {
+				return nil, fmt.Errorf("line %d: invalid string continuation", number+1)
+			}
+			if current != nil {
+				current.WriteString(value)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unexpected content", number+1)
+		}
+	}
+	flush()
+	return acc, nil
+}
+
+type iosParser struct{}
+
+// readQuoted reads a double-quoted literal starting at data[start],
+// returning the unescaped content and the index after the closing quote
+func readQuoted(data []byte, start int) (string, int, error) {
+	for i := start + 1; i < len(data); i++ {
+		if data[i] == '\\' {
+			i++
+			continue
+		}
+		if data[i] == '"' {
+			return unescapeCString(string(data[start+1 : i])), i + 1, nil
+		}
+	}
+	return "", 0, errors.New("unterminated string")
+}
+
+// skipSpaceAndComments skips whitespace together with // and /* */ comments
+func skipSpaceAndComments(data []byte, i int) int {
+	for i < len(data) {
+		switch {
+		case data[i] == ' ' || data[i] == '\t' || data[i] == '\n' || data[i] == '\r':
+			i++
+		case bytes.HasPrefix(data[i:], []byte("//")):
+			end := bytes.IndexByte(data[i:], '\n')
+			if end < 0 {
+				return len(data)
+			}
+			i += end + 1
+		case bytes.HasPrefix(data[i:], []byte("/*")):
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				return len(data)
+			}
+			i += end + 4
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+func (iosParser) Parse(data []byte) (map[string]string, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	acc := make(map[string]string)
+	i := skipSpaceAndComments(data, 0)
+	for i < len(data) {
+		if data[i] != '"' {
+			return nil, fmt.Errorf("offset %d: expected key", i)
+		}
+		key, next, err := readQuoted(data, i)
+		if err != nil {
+			return nil, err
+		}
+		i = skipSpaceAndComments(data, next)
+		if i >= len(data) || data[i] != '=' {
+			return nil, fmt.Errorf("offset %d: expected =", i)
+		}
+		i = skipSpaceAndComments(data, i+1)
+		if i >= len(data) || data[i] != '"' {
+			return nil, fmt.Errorf("offset %d: expected value", i)
+		}
+		value, next, err := readQuoted(data, i)
+		if err != nil {
+			return nil, err
+		}
+		i = skipSpaceAndComments(data, next)
+		if i >= len(data) || data[i] != ';' {
+			return nil, fmt.Errorf("offset %d: expected ;", i)
+		}
+		acc[key] = value
+		i = skipSpaceAndComments(data, i+1)
+	}
+	return acc, nil
+}
+
+type androidParser struct{}
+
+type androidResources struct {
+	Strings []androidString `xml:"string"`
+}
+
+type androidString struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+// unescapeAndroid reverses the aapt string escaping,
+// XML entities are already decoded by the XML decoder
+func unescapeAndroid(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	var buf strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i == len(value)-1 {
+			buf.WriteByte(value[i])
+			continue
+		}
+		i++
+		switch value[i] {
+		case 'n':
+			buf.WriteByte('\n')
+		case 't':
+			buf.WriteByte('\t')
+		default:
+			buf.WriteByte(value[i])
+		}
+	}
+	return buf.String()
+}
+
+func (androidParser) Parse(data []byte) (map[string]string, error) {
+	var resources androidResources
+	if err := xml.Unmarshal(data, &resources); err != nil {
+		return nil, err
+	}
+	acc := make(map[string]string, len(resources.Strings))
+	for _, str := range resources.Strings {
+		if str.Name == "" {
+			continue
+		}
+		acc[str.Name] = unescapeAndroid(str.Value)
+	}
+	return acc, nil
+}
+
+// ResolveKeys maps resource names to the project keys they were exported from,
+// names matching several keys are rejected and unknown names are kept as new keys
+func (androidParser) ResolveKeys(values map[string]string, projectKeys []string) (map[string]string, error) {
+	byName := make(map[string][]string)
+	for _, key := range projectKeys {
+		name := keys.AndroidResourceName(key)
+		byName[name] = append(byName[name], key)
+	}
+
+	resolved := make(map[string]string, len(values))
+	for name, value := range values {
+		key := name
+		switch matches := byName[name]; len(matches) {
+		case 0:
+		case 1:
+			key = matches[0]
+		default:
+			sort.Strings(matches)
+			return nil, fmt.Errorf("resource name %q matches several keys: %s", name, strings.Join(matches, ", "))
+		}
+		if _, exists := resolved[key]; exists {
+			return nil, fmt.Errorf("several resource names resolve to the key %q", key)
+		}
+		resolved[key] = value
+	}
+	return resolved, nil
+}
@@ -0,0 +1,317 @@
+package invitations
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"languageboostergo/auth"
+	"languageboostergo/db"
+	"languageboostergo/mailer"
+	"languageboostergo/signing"
+	"languageboostergo/tokens"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var conn = db.GetDb()
+
+const defaultInvitationTTL = 7 * 24 * time.Hour
+
+type CreateInvitationDto struct {
+	Email string `json:"email" binding:"required,email"`
+	Role  string `json:"role"`
+}
+
+type InvitationTokenDto struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type SimpleInvitation struct {
+	ID          uint      `json:"id"`
+	SpaceID     uint      `json:"spaceId"`
+	SpaceName   string    `json:"spaceName,omitempty"`
+	Email       string    `json:"email"`
+	Role        string    `json:"role"`
+	Status      string    `json:"status"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	InvitedByID uint      `json:"invitedById"`
+}
+
+func toSimpleInvitation(invitation db.Invitation) SimpleInvitation {
+	return SimpleInvitation{
+		ID:          invitation.ID,
+		SpaceID:     invitation.SpaceID,
+		SpaceName:   invitation.Space.Name,
+		Email:       invitation.Email,
+		Role:        invitation.Role,
+		Status:      invitation.Status,
+		ExpiresAt:   invitation.ExpiresAt,
+		InvitedByID: invitation.InvitedByID,
+	}
+}
+
+// secret is resolved at startup so a missing key fails early
+var secret = tokens.Secret("INVITATION_SECRET", signing.Default())
+
+// invitationTTL is read from INVITATION_TTL_HOURS
+func invitationTTL() time.Duration {
+	hours, err := strconv.Atoi(os.Getenv("INVITATION_TTL_HOURS"))
+	if err != nil || hours <= 0 {
+		return defaultInvitationTTL
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+func invitationLink(token string) string {
+	return strings.TrimRight(os.Getenv("APP_URL"), "/") + "/invitations/" + token
+}
+
+func parseSpaceId(c *gin.Context) uint {
+	spaceIdParam, err := strconv.ParseUint(c.Param("spaceId"), 10, 32)
+	if err != nil {
+		panic("Space ID is not number serializable")
+	}
+	return uint(spaceIdParam)
+}
+
+func CreateInvitation(c *gin.Context) {
+	var request CreateInvitationDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	spaceId := parseSpaceId(c)
+	userId := c.MustGet("userId").(uint)
+
+	if request.Role == "" {
+		request.Role = auth.RoleDeveloper
+	}
+
+	callerRole, _ := auth.RequestSpaceRole(c, userId, spaceId)
+	if !auth.Can(callerRole, auth.PermissionMembersManage) {
+		c.JSON(403, "You are not allowed to invite users to this space")
+		return
+	}
+
+	if !auth.CanAssignRole(callerRole, request.Role) {
+		c.JSON(403, "You are not allowed to assign this role")
+		return
+	}
+
+	var space db.Space
+	conn.First(&space, spaceId)
+
+	var inviter db.User
+	conn.First(&inviter, userId)
+
+	token, tokenHash, err := tokens.NewSigned(secret)
+	if err != nil {
+		c.JSON(500, "Error creating invitation token")
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(request.Email))
+
+	invitation := db.Invitation{
+		SpaceID:     spaceId,
+		Space:       space,
+		Email:       email,
+		Role:        request.Role,
+		TokenHash:   tokenHash,
+		ExpiresAt:   time.Now().Add(invitationTTL()),
+		InvitedByID: userId,
+		Status:      db.InvitationPending,
+	}
+
+	// A newer invitation for the same email replaces the pending one
+	err = conn.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&db.Invitation{}).
+			Where("space_id = ? AND email = ? AND status = ?", spaceId, email, db.InvitationPending).
+			Update("status", db.InvitationRevoked).Error
+		if err != nil {
+			return err
+		}
+		return tx.Omit("Space").Create(&invitation).Error
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error creating invitation", "error": err.Error()})
+		return
+	}
+
+	err = mailer.Default().Send(mailer.Message{
+		To:      email,
+		Subject: fmt.Sprintf("%s invited you to %s", inviter.Name, space.Name),
+		Body: fmt.Sprintf(
+			"%s invited you to join the space %s as %s.\n\nAccept or decline the invitation here:\n%s\n\nThe invitation expires on %s.\n",
+			inviter.Name, space.Name, invitation.Role, invitationLink(token), invitation.ExpiresAt.Format(time.RFC1123),
+		),
+	})
+	if err != nil {
+		c.JSON(502, gin.H{"message": "Invitation was created but the mail could not be sent", "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, toSimpleInvitation(invitation))
+}
+
+func ListPendingInvitations(c *gin.Context) {
+	spaceId := parseSpaceId(c)
+	userId := c.MustGet("userId").(uint)
+
+	if !auth.CanInSpace(c, userId, spaceId, auth.PermissionMembersManage) {
+		c.JSON(403, "You are not allowed to manage invitations of this space")
+		return
+	}
+
+	var invitations []db.Invitation
+	conn.Where("space_id = ? AND status = ? AND expires_at > ?", spaceId, db.InvitationPending, time.Now()).
+		Order("created_at desc").
+		Find(&invitations)
+
+	simpleInvitations := make([]SimpleInvitation, len(invitations))
+	for i, v := range invitations {
+		simpleInvitations[i] = toSimpleInvitation(v)
+	}
+
+	c.JSON(200, simpleInvitations)
+}
+
+func RevokeInvitation(c *gin.Context) {
+	spaceId := parseSpaceId(c)
+	invitationIdParam, err := strconv.ParseUint(c.Param("invitationId"), 10, 32)
+	if err != nil {
+		panic("Invitation ID is not number serializable")
+	}
+
+	userId := c.MustGet("userId").(uint)
+	if !auth.CanInSpace(c, userId, spaceId, auth.PermissionMembersManage) {
+		c.JSON(403, "You are not allowed to manage invitations of this space")
+		return
+	}
+
+	var invitation db.Invitation
+	err = conn.Where("space_id = ? AND status = ?", spaceId, db.InvitationPending).First(&invitation, uint(invitationIdParam)).Error
+	if err != nil {
+		c.JSON(404, "Pending invitation does not exist")
+		return
+	}
+
+	invitation.Status = db.InvitationRevoked
+	conn.Save(&invitation)
+	c.JSON(200, toSimpleInvitation(invitation))
+}
+
+// findPendingByToken verifies the token signature and loads the pending invitation it belongs to
+func findPendingByToken(c *gin.Context, token string) (db.Invitation, bool) {
+	var invitation db.Invitation
+	tokenHash, ok := tokens.VerifySigned(secret, token)
+	if !ok {
+		c.JSON(400, "Invalid invitation token")
+		return invitation, false
+	}
+
+	err := conn.Preload("Space").Where("token_hash = ?", tokenHash).First(&invitation).Error
+	if err != nil {
+		c.JSON(404, "Invitation does not exist")
+		return invitation, false
+	}
+
+	if invitation.Status != db.InvitationPending {
+		c.JSON(410, gin.H{"message": "Invitation was already used", "status": invitation.Status})
+		return invitation, false
+	}
+
+	if time.Now().After(invitation.ExpiresAt) {
+		c.JSON(410, gin.H{"message": "Invitation has expired"})
+		return invitation, false
+	}
+
+	return invitation, true
+}
+
+// GetByToken shows the invitation before it gets accepted, it does not require an account
+func GetByToken(c *gin.Context) {
+	invitation, ok := findPendingByToken(c, c.Param("token"))
+	if !ok {
+		return
+	}
+
+	c.JSON(200, toSimpleInvitation(invitation))
+}
+
+func AcceptInvitation(c *gin.Context) {
+	var request InvitationTokenDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	invitation, ok := findPendingByToken(c, request.Token)
+	if !ok {
+		return
+	}
+
+	userId := c.MustGet("userId").(uint)
+	if auth.IsUserInSpace(userId, invitation.SpaceID) {
+		c.JSON(400, "You are already in this space")
+		return
+	}
+
+	// Only the invited address may accept, a forwarded link must not grant the role to someone else
+	var user db.User
+	conn.First(&user, userId)
+	if !strings.EqualFold(strings.TrimSpace(user.Email), strings.TrimSpace(invitation.Email)) {
+		c.JSON(403, gin.H{"message": "This invitation was sent to another email address"})
+		return
+	}
+
+	// The status condition makes sure the token can be used only once
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&db.Invitation{}).
+			Where("id = ? AND status = ?", invitation.ID, db.InvitationPending).
+			Updates(map[string]interface{}{"status": db.InvitationAccepted, "accepted_by_id": userId})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		// The token was mailed to the matching email, so accepting it verifies the email
+		if err := tx.Model(&db.User{}).Where("id = ? AND email_verified_at IS NULL", userId).Update("email_verified_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return tx.Create(&db.UserSpace{UserID: userId, SpaceID: invitation.SpaceID, Role: invitation.Role}).Error
+	})
+	if err != nil {
+		c.JSON(409, gin.H{"message": "Invitation could not be accepted", "error": err.Error()})
+		return
+	}
+
+	invitation.Status = db.InvitationAccepted
+	c.JSON(200, toSimpleInvitation(invitation))
+}
+
+// DeclineInvitation refuses the invitation, it does not require an account
+func DeclineInvitation(c *gin.Context) {
+	var request InvitationTokenDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	invitation, ok := findPendingByToken(c, request.Token)
+	if !ok {
+		return
+	}
+
+	conn.Model(&db.Invitation{}).
+		Where("id = ? AND status = ?", invitation.ID, db.InvitationPending).
+		Update("status", db.InvitationDeclined)
+
+	invitation.Status = db.InvitationDeclined
+	c.JSON(200, toSimpleInvitation(invitation))
+}
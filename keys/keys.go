@@ -0,0 +1,90 @@
+package keys
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Collision describes a leaf key which is at the same time used as a namespace of another key,
+// e.g. "home" and "home.title" cannot be both exported as a nested object
+type Collision struct {
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+}
+
+// Prefixes returns all dotted namespaces of the key, "a.b.c" gives "a" and "a.b"
+func Prefixes(key string) []string {
+	var prefixes []string
+	for i := 0; i < len(key); i++ {
+		if key[i] == '.' {
+			prefixes = append(prefixes, key[:i])
+		}
+	}
+	return prefixes
+}
+
+// FindCollisions reports every pair of keys where one key is a namespace of the other
+func FindCollisions(keys []string) []Collision {
+	existing := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		existing[key] = true
+	}
+
+	collisions := []Collision{}
+	for _, key := range keys {
+		for _, prefix := range Prefixes(key) {
+			if existing[prefix] {
+				collisions = append(collisions, Collision{Namespace: prefix, Key: key})
+			}
+		}
+	}
+
+	sort.Slice(collisions, func(i, j int) bool {
+		if collisions[i].Namespace == collisions[j].Namespace {
+			return collisions[i].Key < collisions[j].Key
+		}
+		return collisions[i].Namespace < collisions[j].Namespace
+	})
+	return collisions
+}
+
+// MoveNamespace replaces the namespace from of the key with to, only whole namespaces
+// are moved so "a" moves "a" and "a.b" but not "ab". It returns false for keys outside of it
+func MoveNamespace(key, from, to string) (string, bool) {
+	if key == from {
+		return to, true
+	}
+	if !strings.HasPrefix(key, from+".") {
+		return key, false
+	}
+	rest := key[len(from)+1:]
+	if to == "" {
+		return rest, true
+	}
+	return to + "." + rest, true
+}
+
+// EscapeLike escapes LIKE wildcards so the value can be used as a literal prefix
+func EscapeLike(value string) string {
+	replacer := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+	return replacer.Replace(value)
+}
+
+// AndroidResourceName converts a dotted key into a valid Android resource name,
+// only letters, digits and underscores are allowed
+func AndroidResourceName(key string) string {
+	var buf strings.Builder
+	for _, r := range key {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_') {
+			buf.WriteRune(r)
+		} else {
+			buf.WriteRune('_')
+		}
+	}
+	name := buf.String()
+	if name == "" || unicode.IsDigit(rune(name[0])) {
+		name = "_" + name
+	}
+	return name
+}
@@ -1,9 +1,15 @@
 package languages
 
 import (
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 	"languageboostergo/auth"
 	"languageboostergo/db"
+	"languageboostergo/history"
+	"languageboostergo/locales"
+	"languageboostergo/plurals"
 	"net/http"
 	"strconv"
 )
@@ -11,12 +17,125 @@ import (
 var conn = db.GetDb()
 
 type CreateLanguageDto struct {
-	ProjectId uint   `json:"projectId" binding:"required"`
-	Name      string `json:"name" binding:"required"`
+	ProjectId   uint   `json:"projectId" binding:"required"`
+	Name        string `json:"name" binding:"required"`
+	Code        string `json:"code" binding:"required"`
+	DisplayName string `json:"displayName"`
+	Direction   string `json:"direction"`
+	PluralRules string `json:"pluralRules"`
+	FallbackId  *uint  `json:"fallbackId"`
+	// SeedFromId copies the values of an existing language into the new one
+	SeedFromId uint `json:"seedFromId"`
 }
 
 type UpdateLanguageDto struct {
-	Name string `json:"name" binding:"required"`
+	Name        string `json:"name"`
+	Code        string `json:"code"`
+	DisplayName string `json:"displayName"`
+	Direction   string `json:"direction"`
+	PluralRules string `json:"pluralRules"`
+	// FallbackId of 0 removes the fallback
+	FallbackId *uint `json:"fallbackId"`
+}
+
+// FallbackChain returns the fallback languages in the order they should be tried,
+// a chain which loops back is cut at the first repeated language
+func FallbackChain(language db.Language) []db.Language {
+	var chain []db.Language
+	visited := map[uint]bool{language.ID: true}
+	current := language
+	for current.FallbackID != nil && !visited[*current.FallbackID] {
+		var next db.Language
+		if err := conn.Where("project_id = ?", language.ProjectID).First(&next, *current.FallbackID).Error; err != nil {
+			break
+		}
+		visited[next.ID] = true
+		chain = append(chain, next)
+		current = next
+	}
+	return chain
+}
+
+// applyFallback validates the fallback language belongs to the same project
+// and does not lead back to the language itself
+func applyFallback(language *db.Language, fallbackId *uint) error {
+	if fallbackId == nil {
+		return nil
+	}
+	if *fallbackId == 0 {
+		language.FallbackID = nil
+		return nil
+	}
+
+	var fallback db.Language
+	if err := conn.Where("project_id = ?", language.ProjectID).First(&fallback, *fallbackId).Error; err != nil {
+		return errors.New("fallback language does not exist in this project")
+	}
+
+	if fallback.ID == language.ID {
+		return errors.New("language cannot fall back to itself")
+	}
+	for _, chained := range FallbackChain(fallback) {
+		if chained.ID == language.ID {
+			return errors.New("fallback chain cannot contain a cycle")
+		}
+	}
+
+	language.FallbackID = &fallback.ID
+	return nil
+}
+
+// codeExists checks whether another language of the project already uses the code
+func codeExists(projectId uint, code string, excludeId uint) bool {
+	var count int64
+	conn.Model(&db.Language{}).Where("project_id = ? AND code = ? AND id <> ?", projectId, code, excludeId).Count(&count)
+	return count > 0
+}
+
+// applyMetadata validates the requested locale metadata and assigns it to the language,
+// values which are not sent are derived from the language code
+func applyMetadata(language *db.Language, code, displayName, direction, pluralRules string) error {
+	if code != "" {
+		normalized, err := locales.Normalize(code)
+		if err != nil {
+			return err
+		}
+		if normalized != language.Code {
+			language.Code = normalized
+			language.DisplayName = ""
+			language.Direction = ""
+			language.PluralRules = ""
+		}
+	}
+
+	if direction != "" {
+		if !locales.IsDirection(direction) {
+			return errors.New("direction has to be ltr or rtl")
+		}
+		language.Direction = direction
+	}
+
+	if pluralRules != "" {
+		if _, ok := plurals.ByName(pluralRules); !ok {
+			return fmt.Errorf("unknown plural rules %q", pluralRules)
+		}
+		language.PluralRules = pluralRules
+	}
+
+	if displayName != "" {
+		language.DisplayName = displayName
+	}
+
+	if language.DisplayName == "" {
+		language.DisplayName = locales.DisplayName(language.Code)
+	}
+	if language.Direction == "" {
+		language.Direction = locales.Direction(language.Code)
+	}
+	if language.PluralRules == "" {
+		language.PluralRules = plurals.ForLocale(language.Code).Name
+	}
+	return nil
 }
 
 func CreateLanguage(c *gin.Context) {
@@ -28,18 +147,117 @@ func CreateLanguage(c *gin.Context) {
 
 	userId := c.MustGet("userId").(uint)
 
-	if !auth.IsUserInProject(userId, data.ProjectId) {
-		c.JSON(403, "You are not in this project")
+	if !auth.RequestAllowsProject(c, data.ProjectId) || !auth.CanInProject(userId, data.ProjectId, auth.PermissionLanguagesManage) {
+		c.JSON(403, "You are not allowed to manage languages in this project")
+		return
+	}
+
+	if auth.IsProjectArchived(data.ProjectId) {
+		c.JSON(403, "This project is archived and read-only")
 		return
 	}
 
 	var newLanguage db.Language
 	newLanguage.ProjectID = data.ProjectId
 	newLanguage.Name = data.Name
-	conn.Create(&newLanguage)
+
+	if err := applyMetadata(&newLanguage, data.Code, data.DisplayName, data.Direction, data.PluralRules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	if err := applyFallback(&newLanguage, data.FallbackId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	if codeExists(newLanguage.ProjectID, newLanguage.Code, 0) {
+		c.JSON(409, gin.H{"message": "Language with this code already exists"})
+		return
+	}
+
+	var seedLanguage *db.Language
+	if data.SeedFromId != 0 {
+		var found db.Language
+		if err := conn.Where("project_id = ?", data.ProjectId).First(&found, data.SeedFromId).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Seed language does not exist in this project"})
+			return
+		}
+		seedLanguage = &found
+	}
+
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&newLanguage).Error; err != nil {
+			return err
+		}
+		return backfillValues(tx, userId, newLanguage, seedLanguage)
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error creating language", "error": err.Error()})
+		return
+	}
+
 	c.JSON(200, newLanguage.ToSimpleLanguage())
 }
 
+// backfillValues creates a value of the new language for every existing mutation of the project,
+// so these show up as needing translation. Values can be seeded from another language,
+// the status of seeded values is reset so they get reviewed. Mutations in the trash get
+// values deleted with them, so restoring them brings back a value of the language too
+func backfillValues(tx *gorm.DB, userId uint, language db.Language, seed *db.Language) error {
+	var mutations []db.Mutation
+	if err := tx.Unscoped().Select("id", "plural", "deleted_at").Where("project_id = ?", language.ProjectID).Find(&mutations).Error; err != nil {
+		return err
+	}
+	if len(mutations) == 0 {
+		return nil
+	}
+
+	seedValues := make(map[uint]db.MutationValue)
+	if seed != nil {
+		var values []db.MutationValue
+		if err := tx.Unscoped().Where("language_id = ?", seed.ID).Find(&values).Error; err != nil {
+			return err
+		}
+		for _, value := range values {
+			seedValues[value.MutationId] = value
+		}
+	}
+
+	// Plural forms are only copied when both languages use the same categories
+	samePlurals := seed != nil &&
+		plurals.ForLanguage(seed.PluralRules, seed.Code).Name == plurals.ForLanguage(language.PluralRules, language.Code).Name
+
+	newValues := make([]db.MutationValue, len(mutations))
+	for i, mutation := range mutations {
+		newValues[i] = db.MutationValue{
+			MutationId: mutation.ID,
+			LanguageId: language.ID,
+		}
+		newValues[i].DeletedAt = mutation.DeletedAt
+		// A plural value without its forms would be invalid, so it is left empty
+		if mutation.Plural && !samePlurals {
+			continue
+		}
+		if seedValue, ok := seedValues[mutation.ID]; ok {
+			newValues[i].Value = seedValue.Value
+			if samePlurals {
+				newValues[i].Plurals = seedValue.Plurals
+			}
+		}
+	}
+
+	if err := tx.CreateInBatches(&newValues, 500).Error; err != nil {
+		return err
+	}
+	for _, newValue := range newValues {
+		if err := history.RecordMutationValue(tx, userId, history.ActionCreate, nil, newValue); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func GetLanguagesByProjectId(c *gin.Context) {
 	projectIdParam, err := strconv.ParseUint(c.Param("projectId"), 10, 32)
 	if err != nil {
@@ -49,14 +267,14 @@ func GetLanguagesByProjectId(c *gin.Context) {
 	projectId := uint(projectIdParam)
 	userId := c.MustGet("userId").(uint)
 
-	if !auth.IsUserInProject(userId, projectId) {
+	if !auth.RequestAllowsProject(c, projectId) || !auth.IsUserInProject(userId, projectId) {
 		c.JSON(403, "You are not in this project")
 		return
 	}
 
 	var languages []db.SimpleLanguage
 
-	err = conn.Model(&db.Language{}).Where("project_id = ?", projectId).Find(&languages).Error
+	err = conn.Model(&db.Language{}).Where("project_id = ?", projectId).Order("code asc").Find(&languages).Error
 	if err != nil {
 		c.JSON(500, "Internal server error")
 	}
@@ -82,8 +300,13 @@ func UpdateLanguage(c *gin.Context) {
 
 	userId := c.MustGet("userId").(uint)
 
-	if !auth.IsUserInProject(userId, updatedLanguage.ProjectID) {
-		c.JSON(403, "You are not in this project")
+	if !auth.RequestAllowsProject(c, updatedLanguage.ProjectID) || !auth.CanInProject(userId, updatedLanguage.ProjectID, auth.PermissionLanguagesManage) {
+		c.JSON(403, "You are not allowed to manage languages in this project")
+		return
+	}
+
+	if auth.IsProjectArchived(updatedLanguage.ProjectID) {
+		c.JSON(403, "This project is archived and read-only")
 		return
 	}
 
@@ -91,6 +314,56 @@ func UpdateLanguage(c *gin.Context) {
 		updatedLanguage.Name = request.Name
 	}
 
+	if err := applyMetadata(&updatedLanguage, request.Code, request.DisplayName, request.Direction, request.PluralRules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	if err := applyFallback(&updatedLanguage, request.FallbackId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	if codeExists(updatedLanguage.ProjectID, updatedLanguage.Code, updatedLanguage.ID) {
+		c.JSON(409, gin.H{"message": "Language with this code already exists"})
+		return
+	}
+
 	conn.Save(&updatedLanguage)
 	c.JSON(200, updatedLanguage.ToSimpleLanguage())
 }
+
+func DeleteLanguage(c *gin.Context) {
+	languageId, err := strconv.ParseUint(c.Param("languageId"), 10, 32)
+	if err != nil {
+		panic("Language ID is not number serializable")
+	}
+
+	var language db.Language
+	if err := conn.First(&language, uint(languageId)).Error; err != nil {
+		c.JSON(404, "Language does not exist")
+		return
+	}
+
+	userId := c.MustGet("userId").(uint)
+
+	if !auth.RequestAllowsProject(c, language.ProjectID) || !auth.CanInProject(userId, language.ProjectID, auth.PermissionLanguagesManage) {
+		c.JSON(403, "You are not allowed to manage languages in this project")
+		return
+	}
+
+	if auth.IsProjectArchived(language.ProjectID) {
+		c.JSON(403, "This project is archived and read-only")
+		return
+	}
+
+	err = conn.Transaction(func(tx *gorm.DB) error {
+		return db.DeleteLanguagesCascade(tx, []uint{language.ID})
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error deleting language", "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, language.ToSimpleLanguage())
+}
@@ -0,0 +1,55 @@
+package locales
+
+import (
+	"fmt"
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+)
+
+const (
+	DirectionLTR = "ltr"
+	DirectionRTL = "rtl"
+)
+
+var rtlScripts = map[string]bool{
+	"Arab": true, "Hebr": true, "Thaa": true, "Syrc": true, "Nkoo": true,
+	"Adlm": true, "Rohg": true, "Mand": true, "Samr": true, "Mend": true,
+}
+
+// Normalize validates a BCP 47 language tag and returns its canonical form, e.g. "en_us" gives "en-US"
+func Normalize(code string) (string, error) {
+	tag, err := language.Parse(code)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a valid BCP 47 language tag", code)
+	}
+	return tag.String(), nil
+}
+
+// Direction returns the text direction of the tag's most likely script
+func Direction(code string) string {
+	tag, err := language.Parse(code)
+	if err != nil {
+		return DirectionLTR
+	}
+	script, _ := tag.Script()
+	if rtlScripts[script.String()] {
+		return DirectionRTL
+	}
+	return DirectionLTR
+}
+
+// DisplayName returns the name of the language in the language itself, e.g. "Deutsch (Deutschland)"
+func DisplayName(code string) string {
+	tag, err := language.Parse(code)
+	if err != nil {
+		return code
+	}
+	if name := display.Self.Name(tag); name != "" {
+		return name
+	}
+	return code
+}
+
+func IsDirection(direction string) bool {
+	return direction == DirectionLTR || direction == DirectionRTL
+}
@@ -0,0 +1,159 @@
+package loginguard
+
+import (
+	"languageboostergo/db"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy configures the throttling, every failure above FreeAttempts doubles the delay
+// before the next attempt and reaching a lockout threshold blocks the key for LockoutDuration
+type Policy struct {
+	FreeAttempts            int
+	BaseDelay               time.Duration
+	MaxDelay                time.Duration
+	AccountLockoutThreshold int
+	IPLockoutThreshold      int
+	LockoutDuration         time.Duration
+	// Window is how long a failure counts, older counters start over
+	Window time.Duration
+}
+
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// PolicyFromEnv reads LOGIN_FREE_ATTEMPTS, LOGIN_BACKOFF_BASE_SECONDS, LOGIN_BACKOFF_MAX_SECONDS,
+// LOGIN_LOCKOUT_THRESHOLD, LOGIN_IP_LOCKOUT_THRESHOLD and LOGIN_LOCKOUT_MINUTES
+func PolicyFromEnv() Policy {
+	return Policy{
+		FreeAttempts:            envInt("LOGIN_FREE_ATTEMPTS", 3),
+		BaseDelay:               time.Duration(envInt("LOGIN_BACKOFF_BASE_SECONDS", 1)) * time.Second,
+		MaxDelay:                time.Duration(envInt("LOGIN_BACKOFF_MAX_SECONDS", 900)) * time.Second,
+		AccountLockoutThreshold: envInt("LOGIN_LOCKOUT_THRESHOLD", 10),
+		IPLockoutThreshold:      envInt("LOGIN_IP_LOCKOUT_THRESHOLD", 100),
+		LockoutDuration:         time.Duration(envInt("LOGIN_LOCKOUT_MINUTES", 30)) * time.Minute,
+		Window:                  24 * time.Hour,
+	}
+}
+
+// delay is the backoff after the given number of failures
+func (policy Policy) delay(failures int) time.Duration {
+	exponent := failures - policy.FreeAttempts
+	if exponent < 0 {
+		return 0
+	}
+	if exponent > 30 {
+		return policy.MaxDelay
+	}
+	delay := policy.BaseDelay << exponent
+	if delay > policy.MaxDelay {
+		return policy.MaxDelay
+	}
+	return delay
+}
+
+type Guard struct {
+	Store  Store
+	Policy Policy
+}
+
+func AccountKey(username string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+func IPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Check returns how long the login has to wait, locked tells whether a key is locked out
+func (guard *Guard) Check(now time.Time, keys ...string) (time.Duration, bool, error) {
+	var wait time.Duration
+	locked := false
+	for _, key := range keys {
+		state, err := guard.Store.Get(key)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if state.LockedUntil != nil && now.Before(*state.LockedUntil) {
+			locked = true
+			if remaining := state.LockedUntil.Sub(now); remaining > wait {
+				wait = remaining
+			}
+			continue
+		}
+
+		if now.Sub(state.LastFailureAt) > guard.Policy.Window {
+			continue
+		}
+		if remaining := state.LastFailureAt.Add(guard.Policy.delay(state.Failures)).Sub(now); remaining > wait {
+			wait = remaining
+		}
+	}
+	return wait, locked, nil
+}
+
+// Fail counts a failed login of the account from the IP address and locks the keys
+// reaching their threshold, it returns whether the account got locked
+func (guard *Guard) Fail(now time.Time, accountKey, ipKey string) (bool, error) {
+	accountLocked, err := guard.fail(now, accountKey, guard.Policy.AccountLockoutThreshold)
+	if err != nil {
+		return false, err
+	}
+	if _, err := guard.fail(now, ipKey, guard.Policy.IPLockoutThreshold); err != nil {
+		return false, err
+	}
+	return accountLocked, nil
+}
+
+func (guard *Guard) fail(now time.Time, key string, threshold int) (bool, error) {
+	state, err := guard.Store.Fail(key, now, guard.Policy.Window)
+	if err != nil {
+		return false, err
+	}
+	if state.Failures < threshold {
+		return false, nil
+	}
+	return true, guard.Store.Lock(key, now.Add(guard.Policy.LockoutDuration))
+}
+
+// Succeed clears the account counter, the IP counter is kept
+// so one valid account does not unlock guessing of others
+func (guard *Guard) Succeed(accountKey string) error {
+	return guard.Store.Reset(accountKey)
+}
+
+// Unlock clears the counter and the lockout of the account
+func (guard *Guard) Unlock(username string) error {
+	return guard.Store.Reset(AccountKey(username))
+}
+
+// FromEnv builds the guard with the store selected by LOGIN_THROTTLE_STORE,
+// "postgres" shares the state between instances, anything else keeps it in memory
+func FromEnv() *Guard {
+	var store Store = NewMemoryStore()
+	if os.Getenv("LOGIN_THROTTLE_STORE") == "postgres" {
+		store = PostgresStore{DB: db.GetDb()}
+	}
+	return &Guard{Store: store, Policy: PolicyFromEnv()}
+}
+
+// defaultGuard is built eagerly as lazily creating it could race between the first requests
+var defaultGuard = FromEnv()
+
+// Default returns the guard shared by the application
+func Default() *Guard {
+	return defaultGuard
+}
+
+// SetDefault replaces the shared guard, e.g. with a different store
+func SetDefault(guard *Guard) {
+	defaultGuard = guard
+}
@@ -0,0 +1,132 @@
+package loginguard
+
+import (
+	"errors"
+	"gorm.io/gorm"
+	"languageboostergo/db"
+	"sync"
+	"time"
+)
+
+// State is the failed login counter of one key
+type State struct {
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+// Store keeps the failure counters, MemoryStore serves a single instance
+// and PostgresStore shares the counters between instances
+type Store interface {
+	Get(key string) (State, error)
+	// Fail atomically counts a failure, counters older than the window start over
+	Fail(key string, now time.Time, window time.Duration) (State, error)
+	// Lock blocks the key until the time and starts its counter over
+	Lock(key string, until time.Time) error
+	Reset(key string) error
+}
+
+// memoryStoreSweepSize is the number of keys after which stale counters get dropped
+const memoryStoreSweepSize = 10000
+
+type MemoryStore struct {
+	mu     sync.Mutex
+	states map[string]State
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{states: map[string]State{}}
+}
+
+func (store *MemoryStore) Get(key string) (State, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.states[key], nil
+}
+
+func (store *MemoryStore) Fail(key string, now time.Time, window time.Duration) (State, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if len(store.states) >= memoryStoreSweepSize {
+		store.sweep(now, window)
+	}
+
+	state := store.states[key]
+	if now.Sub(state.LastFailureAt) > window {
+		state.Failures = 0
+	}
+	state.Failures++
+	state.LastFailureAt = now
+	store.states[key] = state
+	return state, nil
+}
+
+// sweep drops counters which are neither recent nor locked
+func (store *MemoryStore) sweep(now time.Time, window time.Duration) {
+	for key, state := range store.states {
+		locked := state.LockedUntil != nil && now.Before(*state.LockedUntil)
+		if !locked && now.Sub(state.LastFailureAt) > window {
+			delete(store.states, key)
+		}
+	}
+}
+
+func (store *MemoryStore) Lock(key string, until time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	state := store.states[key]
+	state.Failures = 0
+	state.LockedUntil = &until
+	store.states[key] = state
+	return nil
+}
+
+func (store *MemoryStore) Reset(key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.states, key)
+	return nil
+}
+
+type PostgresStore struct {
+	DB *gorm.DB
+}
+
+func (store PostgresStore) Get(key string) (State, error) {
+	var attempt db.LoginAttempt
+	err := store.DB.Where("key = ?", key).First(&attempt).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return State{}, nil
+	}
+	if err != nil {
+		return State{}, err
+	}
+	return State{Failures: attempt.Failures, LastFailureAt: attempt.LastFailureAt, LockedUntil: attempt.LockedUntil}, nil
+}
+
+func (store PostgresStore) Fail(key string, now time.Time, window time.Duration) (State, error) {
+	var attempt db.LoginAttempt
+	err := store.DB.Raw(`
+		INSERT INTO login_attempts (key, failures, last_failure_at) VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_attempts.last_failure_at < ? THEN 1 ELSE login_attempts.failures + 1 END,
+			last_failure_at = EXCLUDED.last_failure_at
+		RETURNING key, failures, last_failure_at, locked_until`,
+		key, now, now.Add(-window),
+	).Scan(&attempt).Error
+	if err != nil {
+		return State{}, err
+	}
+	return State{Failures: attempt.Failures, LastFailureAt: attempt.LastFailureAt, LockedUntil: attempt.LockedUntil}, nil
+}
+
+func (store PostgresStore) Lock(key string, until time.Time) error {
+	return store.DB.Model(&db.LoginAttempt{}).
+		Where("key = ?", key).
+		Updates(map[string]interface{}{"failures": 0, "locked_until": until}).Error
+}
+
+func (store PostgresStore) Reset(key string) error {
+	return store.DB.Where("key = ?", key).Delete(&db.LoginAttempt{}).Error
+}
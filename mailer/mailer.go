@@ -0,0 +1,92 @@
+package mailer
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages to users, SMTP is used in production
+type Mailer interface {
+	Send(message Message) error
+}
+
+// SMTPMailer sends plain text mails through an SMTP server,
+// authentication is skipped when no username is configured, e.g. for a local SMTP stand-in
+type SMTPMailer struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (mailer SMTPMailer) Send(message Message) error {
+	var auth smtp.Auth
+	if mailer.Username != "" {
+		host := mailer.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", mailer.Username, mailer.Password, host)
+	}
+
+	// Header injection is prevented by stripping line breaks from header values
+	headerValue := strings.NewReplacer("\r", "", "\n", "").Replace
+	body := fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		headerValue(mailer.From),
+		headerValue(message.To),
+		headerValue(message.Subject),
+		message.Body,
+	)
+
+	return smtp.SendMail(mailer.Addr, auth, mailer.From, []string{message.To}, []byte(body))
+}
+
+// LogMailer prints messages instead of sending them, used when SMTP is not configured
+type LogMailer struct{}
+
+func (LogMailer) Send(message Message) error {
+	fmt.Printf("Mail to %s: %s\n%s\n", message.To, message.Subject, message.Body)
+	return nil
+}
+
+var defaultMailer Mailer
+
+// FromEnv builds the mailer from SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD and SMTP_FROM
+func FromEnv() Mailer {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return LogMailer{}
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	return SMTPMailer{
+		Addr:     host + ":" + port,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+	}
+}
+
+// Default returns the mailer shared by the application
+func Default() Mailer {
+	if defaultMailer == nil {
+		defaultMailer = FromEnv()
+	}
+	return defaultMailer
+}
+
+// SetDefault replaces the shared mailer, e.g. with a stand-in
+func SetDefault(mailer Mailer) {
+	defaultMailer = mailer
+}
@@ -0,0 +1,135 @@
+package mailer
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpStandIn is a minimal SMTP server which accepts one mail and records the transaction
+type smtpStandIn struct {
+	listener   net.Listener
+	from       string
+	recipients []string
+	data       string
+	done       chan struct{}
+}
+
+func startSMTPStandIn(t *testing.T) *smtpStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &smtpStandIn{listener: listener, done: make(chan struct{})}
+	go server.serve()
+	t.Cleanup(func() { listener.Close() })
+	return server
+}
+
+func (server *smtpStandIn) serve() {
+	defer close(server.done)
+	conn, err := server.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ESMTP stand-in")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			server.from = strings.Trim(line[len("MAIL FROM:"):], "<> ")
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			server.recipients = append(server.recipients, strings.Trim(line[len("RCPT TO:"):], "<> "))
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(dataLine)
+			}
+			server.data = data.String()
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestSMTPMailerSendsThroughStandIn(t *testing.T) {
+	server := startSMTPStandIn(t)
+
+	mailer := SMTPMailer{Addr: server.listener.Addr().String(), From: "noreply@example.com"}
+	err := mailer.Send(Message{
+		To:      "alice@example.com",
+		Subject: "You were invited",
+		Body:    "Open https://example.com/invitations/token to join",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-server.done
+
+	if server.from != "noreply@example.com" {
+		t.Errorf("sender = %q", server.from)
+	}
+	if len(server.recipients) != 1 || server.recipients[0] != "alice@example.com" {
+		t.Errorf("recipients = %v", server.recipients)
+	}
+	for _, expected := range []string{"To: alice@example.com\r\n", "Subject: You were invited\r\n", "https://example.com/invitations/token"} {
+		if !strings.Contains(server.data, expected) {
+			t.Errorf("mail does not contain %q:\n%s", expected, server.data)
+		}
+	}
+}
+
+func TestSMTPMailerStripsHeaderInjection(t *testing.T) {
+	server := startSMTPStandIn(t)
+
+	mailer := SMTPMailer{Addr: server.listener.Addr().String(), From: "noreply@example.com"}
+	err := mailer.Send(Message{
+		To:      "alice@example.com",
+		Subject: "Hello\r\nBcc: mallory@example.com",
+		Body:    "Body",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-server.done
+
+	if strings.Contains(server.data, "\r\nBcc:") {
+		t.Errorf("subject injected a header:\n%s", server.data)
+	}
+}
+
+func TestFromEnvWithoutHostLogs(t *testing.T) {
+	t.Setenv("SMTP_HOST", "")
+	if _, ok := FromEnv().(LogMailer); !ok {
+		t.Error("expected the log mailer without SMTP_HOST")
+	}
+}
@@ -3,18 +3,74 @@ package main
 import (
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"languageboostergo/apitokens"
 	"languageboostergo/export"
+	"languageboostergo/imports"
+	"languageboostergo/invitations"
 	"languageboostergo/languages"
 	"languageboostergo/mutations"
 	"languageboostergo/projects"
 	"languageboostergo/spaces"
 	"languageboostergo/users"
+	"time"
 )
 
+// apiTokenScopes lists the only routes reachable with API tokens and the scope each requires
+var apiTokenScopes = map[string]string{
+	"POST /export":                              apitokens.ScopeExportRead,
+	"POST /import":                              apitokens.ScopeImportWrite,
+	"GET /mutations/:mutationId":                apitokens.ScopeMutationsRead,
+	"GET /mutations/project/:projectId":         apitokens.ScopeMutationsRead,
+	"POST /mutations/project/:projectId/search": apitokens.ScopeMutationsRead,
+	"POST /mutations":                           apitokens.ScopeMutationsWrite,
+	"POST /mutations/project/:projectId/bulk":   apitokens.ScopeMutationsWrite,
+	"PUT /mutations/:mutationId":                apitokens.ScopeMutationsWrite,
+	"DELETE /mutations/:mutationId":             apitokens.ScopeMutationsWrite,
+	"POST /mutations/value":                     apitokens.ScopeMutationsWrite,
+	"PUT /mutations/value/:mutationValueId":     apitokens.ScopeMutationsWrite,
+	"GET /languages/:projectId":                 apitokens.ScopeLanguagesRead,
+}
+
+// authenticateApiToken accepts API tokens on routes listed in apiTokenScopes
+func authenticateApiToken(c *gin.Context, header string) {
+	token, err := apitokens.Authenticate(header)
+	if err != nil {
+		c.JSON(403, "Invalid token")
+		c.Abort()
+		return
+	}
+
+	scope, allowed := apiTokenScopes[c.Request.Method+" "+c.FullPath()]
+	if !allowed {
+		c.JSON(403, "API tokens cannot access this endpoint")
+		c.Abort()
+		return
+	}
+
+	if !apitokens.HasScope(token, scope) {
+		c.JSON(403, gin.H{"message": "Token is missing the required scope", "scope": scope})
+		c.Abort()
+		return
+	}
+
+	c.Set("userId", token.UserID)
+	c.Set("apiTokenId", token.ID)
+	c.Set("authMethod", token.AuthMethod)
+	if token.ProjectID != nil {
+		c.Set("tokenProjectId", *token.ProjectID)
+	}
+	c.Next()
+}
+
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		tokenString := c.GetHeader("Authorization")
-		userId, err := users.ParseToken(tokenString)
+		if apitokens.IsApiToken(tokenString) {
+			authenticateApiToken(c, tokenString)
+			return
+		}
+
+		userId, session, err := users.ParseToken(tokenString)
 		if err != nil {
 			c.JSON(403, "Invalid token")
 			c.Abort()
@@ -22,25 +78,58 @@ func AuthMiddleware() gin.HandlerFunc {
 		}
 
 		c.Set("userId", userId)
+		c.Set("sessionId", session.ID)
+		c.Set("authMethod", session.AuthMethod)
 		c.Next()
 	}
 }
 
 func main() {
+	mutations.StartTrashPurge(time.Hour)
+
 	r := gin.Default()
 
 	//r.Use(cors.Default())
 	r.Use(cors.New(cors.Config{
 		AllowAllOrigins: true,
 		AllowMethods:    []string{"GET", "POST", "PUT", "DELETE", "HEAD"},
-		AllowHeaders:    []string{"Origin", "Content-Length", "Content-Type", "Authorization"},
-		ExposeHeaders:   []string{"Content-Length", "Content-Type", "Authorization"},
+		AllowHeaders:    []string{"Origin", "Content-Length", "Content-Type", "Authorization", "Refresh-Token"},
+		ExposeHeaders:   []string{"Content-Length", "Content-Type", "Authorization", "Refresh-Token", "Content-Disposition"},
 	}))
 
+	r.GET("/.well-known/jwks.json", users.GetJWKS)
+
 	usersGroup := r.Group("/users")
 	usersGroup.GET("current", AuthMiddleware(), users.GetCurrent)
 	usersGroup.POST("create", users.CreateUser)
 	usersGroup.POST("login", users.LoginUser)
+	usersGroup.POST("login/two-factor", users.LoginTwoFactor)
+	usersGroup.GET("sso/start", users.StartSSO)
+	usersGroup.POST("sso/callback", users.FinishSSO)
+	usersGroup.POST("sso/link", users.LinkSSO)
+	usersGroup.POST("refresh", users.RefreshSession)
+	usersGroup.POST("logout", AuthMiddleware(), users.Logout)
+	usersGroup.POST("logout-all", AuthMiddleware(), users.LogoutEverywhere)
+	usersGroup.GET("sessions", AuthMiddleware(), users.ListSessions)
+	usersGroup.GET("password-policy", users.GetPasswordPolicy)
+	usersGroup.POST("change-password", AuthMiddleware(), users.ChangePassword)
+	usersGroup.POST("forgot-password", users.ForgotPassword)
+	usersGroup.POST("reset-password", users.ResetPassword)
+	usersGroup.POST("two-factor/setup", AuthMiddleware(), users.SetupTwoFactor)
+	usersGroup.POST("two-factor/enable", AuthMiddleware(), users.EnableTwoFactor)
+	usersGroup.POST("two-factor/disable", AuthMiddleware(), users.DisableTwoFactor)
+	usersGroup.POST("two-factor/recovery-codes", AuthMiddleware(), users.RegenerateRecoveryCodes)
+
+	adminGroup := r.Group("/admin")
+	adminGroup.Use(AuthMiddleware())
+	adminGroup.GET("login-audit", users.ListLoginAudit)
+	adminGroup.POST("users/:userId/unlock", users.UnlockUser)
+
+	tokensGroup := r.Group("/tokens")
+	tokensGroup.Use(AuthMiddleware())
+	tokensGroup.GET("", apitokens.ListApiTokens)
+	tokensGroup.POST("", apitokens.CreateApiToken)
+	tokensGroup.DELETE(":tokenId", apitokens.RevokeApiToken)
 
 	spacesGroup := r.Group("/spaces")
 	spacesGroup.Use(AuthMiddleware())
@@ -50,6 +139,20 @@ func main() {
 	spacesGroup.POST("", spaces.CreateSpace)
 	spacesGroup.POST("add-user/:spaceId/:username", spaces.AddUserToSpace)
 	spacesGroup.POST("leave/:spaceId", spaces.LeaveSpace)
+	spacesGroup.DELETE(":spaceId", spaces.DeleteSpace)
+	spacesGroup.GET(":spaceId/members", spaces.ListMembers)
+	spacesGroup.PUT(":spaceId/members/:userId", spaces.UpdateMemberRole)
+	spacesGroup.DELETE(":spaceId/members/:userId", spaces.RemoveMember)
+	spacesGroup.PUT(":spaceId/two-factor", spaces.UpdateTwoFactorPolicy)
+	spacesGroup.PUT(":spaceId/sso", spaces.UpdateSSOPolicy)
+	spacesGroup.POST(":spaceId/invitations", invitations.CreateInvitation)
+	spacesGroup.GET(":spaceId/invitations", invitations.ListPendingInvitations)
+	spacesGroup.DELETE(":spaceId/invitations/:invitationId", invitations.RevokeInvitation)
+
+	invitationsGroup := r.Group("/invitations")
+	invitationsGroup.GET(":token", invitations.GetByToken)
+	invitationsGroup.POST("accept", AuthMiddleware(), invitations.AcceptInvitation)
+	invitationsGroup.POST("decline", invitations.DeclineInvitation)
 
 	projectsGroup := r.Group("/projects")
 	projectsGroup.Use(AuthMiddleware())
@@ -57,27 +160,46 @@ func main() {
 	projectsGroup.GET(":spaceId", projects.ListProjects)
 	projectsGroup.POST("", projects.CreateProject)
 	projectsGroup.PUT(":projectId", projects.UpdateProject)
+	projectsGroup.DELETE(":projectId", projects.DeleteProject)
+	projectsGroup.POST(":projectId/archive", projects.ArchiveProject)
+	projectsGroup.POST(":projectId/unarchive", projects.UnarchiveProject)
+	projectsGroup.GET("by-id/:projectId/members/:userId/languages", projects.GetMemberLanguages)
+	projectsGroup.PUT("by-id/:projectId/members/:userId/languages", projects.UpdateMemberLanguages)
+	projectsGroup.GET("by-id/:projectId/workflow", projects.GetWorkflow)
+	projectsGroup.PUT(":projectId/workflow", projects.UpdateWorkflow)
 
 	languagesGroup := r.Group("/languages")
 	languagesGroup.Use(AuthMiddleware())
 	languagesGroup.GET(":projectId", languages.GetLanguagesByProjectId)
 	languagesGroup.POST("", languages.CreateLanguage)
 	languagesGroup.PUT(":languageId", languages.UpdateLanguage)
+	languagesGroup.DELETE(":languageId", languages.DeleteLanguage)
 
 	mutationsGroup := r.Group("/mutations")
 	mutationsGroup.Use(AuthMiddleware())
 	mutationsGroup.POST("/project/:projectId/search", mutations.SearchByProject)
+	mutationsGroup.POST("/project/:projectId/bulk", mutations.BulkByProject)
 	mutationsGroup.GET(":mutationId", mutations.GetById)
 	mutationsGroup.GET("/project/:projectId", mutations.ListByProject)
+	mutationsGroup.GET("/project/:projectId/lint", mutations.LintByProject)
 	mutationsGroup.POST("", mutations.CreateMutation)
 	mutationsGroup.PUT(":mutationId", mutations.UpdateMutation)
 	mutationsGroup.DELETE(":mutationId", mutations.DeleteById)
 	mutationsGroup.POST("/value", mutations.CreateMutationValue)
 	mutationsGroup.PUT("/value/:mutationValueId", mutations.UpdateMutationValue)
+	mutationsGroup.GET("/project/:projectId/trash", mutations.ListTrashByProject)
+	mutationsGroup.GET(":mutationId/history", mutations.GetHistory)
+	mutationsGroup.POST("/value/:mutationValueId/revert/:revisionId", mutations.RevertMutationValue)
+	mutationsGroup.POST("/trash/:mutationId/restore", mutations.RestoreFromTrash)
+	mutationsGroup.DELETE("/trash/:mutationId", mutations.PurgeFromTrash)
 
 	exportsGroup := r.Group("/export")
 	exportsGroup.Use(AuthMiddleware())
 	exportsGroup.POST("", export.ByProjectIdAndLanguageId)
+
+	importsGroup := r.Group("/import")
+	importsGroup.Use(AuthMiddleware())
+	importsGroup.POST("", imports.IntoLanguage)
 	err := r.Run()
 
 	if err != nil {
@@ -0,0 +1,474 @@
+package mutations
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"languageboostergo/auth"
+	"languageboostergo/db"
+	"languageboostergo/history"
+	"languageboostergo/keys"
+	"languageboostergo/workflow"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	BulkSetStatus      = "setStatus"
+	BulkSetValueStatus = "setValueStatus"
+	BulkDelete         = "delete"
+	BulkAddTags        = "addTags"
+	BulkRemoveTags     = "removeTags"
+	BulkMovePrefix     = "movePrefix"
+
+	maxBulkMutations = 1000
+)
+
+// errBulkRejected rolls the bulk transaction back when any item failed
+var errBulkRejected = errors.New("bulk operation was rejected")
+
+type BulkMutationsDto struct {
+	// Either MutationIds or Filter selects the mutations
+	MutationIds []uint              `json:"mutationIds"`
+	Filter      *SearchMutationsDto `json:"filter"`
+	Action      string              `json:"action" binding:"required"`
+	// Status is used by setStatus and by setValueStatus on the values of LanguageIds
+	Status      string   `json:"status"`
+	LanguageIds []uint   `json:"languageIds"`
+	Tags        []string `json:"tags"`
+	// FromPrefix is the namespace movePrefix moves to ToPrefix, an empty ToPrefix moves the keys to the top level
+	FromPrefix string `json:"fromPrefix"`
+	ToPrefix   string `json:"toPrefix"`
+}
+
+type BulkItemResult struct {
+	MutationID uint   `json:"mutationId"`
+	Key        string `json:"key"`
+	NewKey     string `json:"newKey,omitempty"`
+	// Changed is false when the mutation already was in the requested state
+	Changed bool   `json:"changed"`
+	Error   string `json:"error,omitempty"`
+}
+
+type BulkResult struct {
+	Action string `json:"action"`
+	// Applied is false when any item failed, nothing is changed then
+	Applied bool             `json:"applied"`
+	Results []BulkItemResult `json:"results"`
+}
+
+// bulkOperation applies the action to one mutation inside the bulk transaction,
+// it returns whether the mutation changed or the reason the item failed
+type bulkOperation func(tx *gorm.DB, mutation *db.Mutation) (bool, string, error)
+
+// normalizeTags trims the tags and removes duplicates
+func normalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool)
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			return nil, errors.New("tags cannot be empty")
+		}
+		if len(tag) > 64 {
+			return nil, fmt.Errorf("tag %q is longer than 64 characters", tag)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized, nil
+}
+
+// validateBulkRequest checks the selection and the parameters of the action
+func validateBulkRequest(request *BulkMutationsDto) error {
+	if (len(request.MutationIds) == 0) == (request.Filter == nil) {
+		return errors.New("select mutations either by mutationIds or by filter")
+	}
+	if len(request.MutationIds) > maxBulkMutations {
+		return fmt.Errorf("at most %d mutations can be changed at once", maxBulkMutations)
+	}
+
+	switch request.Action {
+	case BulkSetStatus:
+		if request.Status == "" {
+			return errors.New("setStatus needs a status")
+		}
+	case BulkSetValueStatus:
+		if request.Status == "" || len(request.LanguageIds) == 0 {
+			return errors.New("setValueStatus needs a status and languageIds")
+		}
+	case BulkDelete:
+	case BulkAddTags, BulkRemoveTags:
+		tags, err := normalizeTags(request.Tags)
+		if err != nil {
+			return err
+		}
+		if len(tags) == 0 {
+			return fmt.Errorf("%s needs tags", request.Action)
+		}
+		request.Tags = tags
+	case BulkMovePrefix:
+		request.FromPrefix = strings.TrimSuffix(request.FromPrefix, ".")
+		request.ToPrefix = strings.TrimSuffix(request.ToPrefix, ".")
+		if request.FromPrefix == "" {
+			return errors.New("movePrefix needs a fromPrefix")
+		}
+		if request.FromPrefix == request.ToPrefix {
+			return errors.New("fromPrefix and toPrefix are the same")
+		}
+	default:
+		return fmt.Errorf("unknown action %q, use setStatus, setValueStatus, delete, addTags, removeTags or movePrefix", request.Action)
+	}
+	return nil
+}
+
+// selectBulkMutations resolves the IDs of the selected mutations, explicit IDs which are
+// not in the project are returned separately so they can be reported as failed items
+func selectBulkMutations(projectId uint, request BulkMutationsDto) ([]uint, []uint, error) {
+	var ids []uint
+	if request.Filter != nil {
+		err := runSearch(func(tx *gorm.DB) error {
+			query, err := searchQuery(tx, projectId, *request.Filter)
+			if err != nil {
+				return err
+			}
+			return query.Model(&db.Mutation{}).Order("mutations.id").Limit(maxBulkMutations+1).Pluck("mutations.id", &ids).Error
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(ids) > maxBulkMutations {
+			return nil, nil, invalidSearchError{fmt.Errorf("the filter matches more than %d mutations", maxBulkMutations)}
+		}
+		return ids, nil, nil
+	}
+
+	conn.Model(&db.Mutation{}).Where("project_id = ? AND id IN ?", projectId, request.MutationIds).Pluck("id", &ids)
+	found := make(map[uint]bool)
+	for _, id := range ids {
+		found[id] = true
+	}
+	var missing []uint
+	for _, id := range request.MutationIds {
+		if !found[id] {
+			missing = append(missing, id)
+			found[id] = true
+		}
+	}
+	return ids, missing, nil
+}
+
+func setStatusOperation(projectWorkflow workflow.Workflow, role, status string, userId uint) bulkOperation {
+	return func(tx *gorm.DB, mutation *db.Mutation) (bool, string, error) {
+		if err := projectWorkflow.Check(role, mutation.Status, status); err != nil {
+			return false, workflow.Error(err, mutation.Status, status), nil
+		}
+		if mutation.Status == status {
+			return false, "", nil
+		}
+
+		oldMutation := *mutation
+		mutation.Status = status
+		if err := tx.Model(&db.Mutation{}).Where("id = ?", mutation.ID).Update("status", status).Error; err != nil {
+			return false, "", err
+		}
+		return true, "", history.RecordMutation(tx, userId, history.ActionUpdate, &oldMutation, *mutation)
+	}
+}
+
+func setValueStatusOperation(projectWorkflow workflow.Workflow, role, status string, languageIds []uint, userId uint) bulkOperation {
+	return func(tx *gorm.DB, mutation *db.Mutation) (bool, string, error) {
+		var values []db.MutationValue
+		if err := tx.Where("mutation_id = ? AND language_id IN ?", mutation.ID, languageIds).Find(&values).Error; err != nil {
+			return false, "", err
+		}
+		if len(values) != len(languageIds) {
+			return false, "mutation has no value in some of the languages", nil
+		}
+
+		// Every value is checked first so a mutation is either fully changed or reported
+		for _, value := range values {
+			if err := projectWorkflow.Check(role, value.Status, status); err != nil {
+				return false, fmt.Sprintf("language %d: %s", value.LanguageId, workflow.Error(err, value.Status, status)), nil
+			}
+		}
+
+		changed := false
+		for _, value := range values {
+			if value.Status == status {
+				continue
+			}
+			oldValue := value
+			value.Status = status
+			value.ClearOutdated()
+			err := tx.Model(&db.MutationValue{}).Where("id = ?", value.ID).Updates(map[string]interface{}{
+				"status":           value.Status,
+				"old_source_value": value.OldSourceValue,
+				"new_source_value": value.NewSourceValue,
+			}).Error
+			if err != nil {
+				return false, "", err
+			}
+			if err := history.RecordMutationValue(tx, userId, history.ActionUpdate, &oldValue, value); err != nil {
+				return false, "", err
+			}
+			changed = true
+		}
+		return changed, "", nil
+	}
+}
+
+func deleteOperation(userId uint) bulkOperation {
+	return func(tx *gorm.DB, mutation *db.Mutation) (bool, string, error) {
+		if err := tx.Where("mutation_id = ?", mutation.ID).Delete(&db.MutationValue{}).Error; err != nil {
+			return false, "", err
+		}
+		if err := tx.Delete(mutation).Error; err != nil {
+			return false, "", err
+		}
+		return true, "", history.RecordMutation(tx, userId, history.ActionDelete, mutation, *mutation)
+	}
+}
+
+func tagsOperation(tags []string, add bool) bulkOperation {
+	return func(tx *gorm.DB, mutation *db.Mutation) (bool, string, error) {
+		current := make(map[string]bool)
+		for _, tag := range mutation.Tags {
+			current[tag] = true
+		}
+
+		updated := db.Tags{}
+		if add {
+			updated = append(updated, mutation.Tags...)
+			for _, tag := range tags {
+				if !current[tag] {
+					updated = append(updated, tag)
+				}
+			}
+		} else {
+			removed := make(map[string]bool)
+			for _, tag := range tags {
+				removed[tag] = true
+			}
+			for _, tag := range mutation.Tags {
+				if !removed[tag] {
+					updated = append(updated, tag)
+				}
+			}
+		}
+
+		if len(updated) == len(mutation.Tags) {
+			return false, "", nil
+		}
+		sort.Strings(updated)
+		mutation.Tags = updated
+		return true, "", tx.Model(&db.Mutation{}).Where("id = ?", mutation.ID).Update("tags", updated).Error
+	}
+}
+
+// movePrefixOperation renames the keys, the resulting keys of the whole project
+// are checked up front so no rename can clash with another key
+func movePrefixOperation(tx *gorm.DB, projectId uint, ids []uint, fromPrefix, toPrefix string, userId uint) (bulkOperation, error) {
+	var projectMutations []db.Mutation
+	if err := tx.Select("id", "key").Where("project_id = ?", projectId).Find(&projectMutations).Error; err != nil {
+		return nil, err
+	}
+
+	selected := make(map[uint]bool)
+	for _, id := range ids {
+		selected[id] = true
+	}
+
+	finalKeys := make(map[uint]string)
+	owners := make(map[string][]uint)
+	for _, mutation := range projectMutations {
+		key := mutation.Key
+		if selected[mutation.ID] {
+			key, _ = keys.MoveNamespace(key, fromPrefix, toPrefix)
+		}
+		finalKeys[mutation.ID] = key
+		owners[key] = append(owners[key], mutation.ID)
+	}
+
+	allKeys := make([]string, 0, len(owners))
+	for key := range owners {
+		allKeys = append(allKeys, key)
+	}
+	collisions := make(map[string]string)
+	for _, collision := range keys.FindCollisions(allKeys) {
+		collisions[collision.Namespace] = collision.Key
+		collisions[collision.Key] = collision.Namespace
+	}
+
+	return func(tx *gorm.DB, mutation *db.Mutation) (bool, string, error) {
+		if _, ok := keys.MoveNamespace(mutation.Key, fromPrefix, toPrefix); !ok {
+			return false, fmt.Sprintf("key is not in the namespace %q", fromPrefix), nil
+		}
+		key := finalKeys[mutation.ID]
+		if key == "" {
+			return false, "key would be empty", nil
+		}
+		if len(owners[key]) > 1 {
+			return false, fmt.Sprintf("key %q would exist twice", key), nil
+		}
+		if other, ok := collisions[key]; ok {
+			return false, fmt.Sprintf("key %q would collide with %q", key, other), nil
+		}
+
+		oldMutation := *mutation
+		mutation.Key = key
+		if err := tx.Model(&db.Mutation{}).Where("id = ?", mutation.ID).Update("key", key).Error; err != nil {
+			return false, "", err
+		}
+		return true, "", history.RecordMutation(tx, userId, history.ActionUpdate, &oldMutation, *mutation)
+	}, nil
+}
+
+// BulkByProject applies one action to many mutations of the project in a single transaction,
+// when any item fails nothing is changed and the results tell which items failed
+func BulkByProject(c *gin.Context) {
+	projectIdParam, err := strconv.ParseUint(c.Param("projectId"), 10, 32)
+	if err != nil {
+		c.JSON(405, "Project ID is invalid")
+		return
+	}
+
+	projectId := uint(projectIdParam)
+	userId := c.MustGet("userId").(uint)
+
+	var request BulkMutationsDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := validateBulkRequest(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Reviewers may change value statuses, every other action changes keys
+	role, _ := auth.ProjectRole(userId, projectId)
+	allowed := auth.Can(role, auth.PermissionKeysWrite)
+	if request.Action == BulkSetValueStatus {
+		allowed = auth.Can(role, auth.PermissionValuesWrite) || auth.Can(role, auth.PermissionValuesReview)
+	}
+	if !auth.RequestAllowsProject(c, projectId) || !allowed {
+		c.JSON(403, "You are not allowed to make this change in this project")
+		return
+	}
+
+	if request.Action == BulkSetValueStatus {
+		var count int64
+		conn.Model(&db.Language{}).Where("project_id = ? AND id IN ?", projectId, request.LanguageIds).Count(&count)
+		if int(count) != len(request.LanguageIds) {
+			c.JSON(400, "Some languages do not exist in this project")
+			return
+		}
+		languageAccess := auth.GetLanguageAccess(userId, projectId)
+		for _, languageId := range request.LanguageIds {
+			if !languageAccess.IsLanguageAllowed(languageId) {
+				c.JSON(403, gin.H{"message": "You are not allowed to edit this language", "languageId": languageId})
+				return
+			}
+		}
+	}
+
+	if auth.IsProjectArchived(projectId) {
+		c.JSON(403, "This project is archived and read-only")
+		return
+	}
+
+	ids, missing, err := selectBulkMutations(projectId, request)
+	if err != nil {
+		c.JSON(searchStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	result := BulkResult{Action: request.Action, Results: []BulkItemResult{}}
+	for _, id := range missing {
+		result.Results = append(result.Results, BulkItemResult{MutationID: id, Error: "Mutation does not exist in this project"})
+	}
+
+	projectWorkflow := workflow.ForProject(projectId)
+	err = conn.Transaction(func(tx *gorm.DB) error {
+		var operation bulkOperation
+		switch request.Action {
+		case BulkSetStatus:
+			operation = setStatusOperation(projectWorkflow, role, request.Status, userId)
+		case BulkSetValueStatus:
+			operation = setValueStatusOperation(projectWorkflow, role, request.Status, request.LanguageIds, userId)
+		case BulkDelete:
+			operation = deleteOperation(userId)
+		case BulkAddTags, BulkRemoveTags:
+			operation = tagsOperation(request.Tags, request.Action == BulkAddTags)
+		case BulkMovePrefix:
+			var err error
+			operation, err = movePrefixOperation(tx, projectId, ids, request.FromPrefix, request.ToPrefix, userId)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Keys growing into a nested namespace are renamed longest first and keys shrinking out
+		// of it shortest first, so no rename hits a key which is only renamed later,
+		// e.g. "a" to "a.b" with "a.x" and "a.b.x"
+		order := "key"
+		if request.Action == BulkMovePrefix {
+			order = "LENGTH(key), key"
+			if len(request.ToPrefix) > len(request.FromPrefix) {
+				order = "LENGTH(key) desc, key"
+			}
+		}
+
+		var mutations []db.Mutation
+		if len(ids) > 0 {
+			if err := tx.Where("id IN ?", ids).Order(order).Find(&mutations).Error; err != nil {
+				return err
+			}
+		}
+
+		failed := len(missing) > 0
+		for i := range mutations {
+			key := mutations[i].Key
+			changed, reason, err := operation(tx, &mutations[i])
+			if err != nil {
+				return err
+			}
+			item := BulkItemResult{MutationID: mutations[i].ID, Key: key, Changed: changed, Error: reason}
+			if mutations[i].Key != key {
+				item.NewKey = mutations[i].Key
+			}
+			result.Results = append(result.Results, item)
+			if reason != "" {
+				failed = true
+			}
+		}
+
+		if failed {
+			return errBulkRejected
+		}
+		return nil
+	})
+
+	if errors.Is(err, errBulkRejected) {
+		// Nothing was applied, so no item counts as changed
+		for i := range result.Results {
+			result.Results[i].Changed = false
+		}
+		c.JSON(422, result)
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error applying bulk operation", "error": err.Error()})
+		return
+	}
+
+	result.Applied = true
+	c.JSON(200, result)
+}
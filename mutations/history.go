@@ -0,0 +1,164 @@
+package mutations
+
+import (
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"languageboostergo/auth"
+	"languageboostergo/db"
+	"languageboostergo/history"
+	"languageboostergo/workflow"
+	"strconv"
+	"time"
+)
+
+type RevisionResponse struct {
+	ID              uint           `json:"id"`
+	CreatedAt       time.Time      `json:"createdAt"`
+	MutationValueID *uint          `json:"mutationValueId"`
+	LanguageID      *uint          `json:"languageId"`
+	User            db.SimpleUser  `json:"user"`
+	Action          string         `json:"action"`
+	OldKey          string         `json:"oldKey,omitempty"`
+	NewKey          string         `json:"newKey,omitempty"`
+	OldStatus       string         `json:"oldStatus"`
+	NewStatus       string         `json:"newStatus"`
+	OldValue        string         `json:"oldValue"`
+	NewValue        string         `json:"newValue"`
+	OldPlurals      db.PluralForms `json:"oldPlurals,omitempty"`
+	NewPlurals      db.PluralForms `json:"newPlurals,omitempty"`
+	OldPlural       *bool          `json:"oldPlural,omitempty"`
+	NewPlural       *bool          `json:"newPlural,omitempty"`
+	OldTags         db.Tags        `json:"oldTags,omitempty"`
+	NewTags         db.Tags        `json:"newTags,omitempty"`
+}
+
+func toRevisionResponse(revision db.Revision) RevisionResponse {
+	return RevisionResponse{
+		ID:              revision.ID,
+		CreatedAt:       revision.CreatedAt,
+		MutationValueID: revision.MutationValueID,
+		LanguageID:      revision.LanguageID,
+		User:            revision.User.ToSimpleUser(),
+		Action:          revision.Action,
+		OldKey:          revision.OldKey,
+		NewKey:          revision.NewKey,
+		OldStatus:       revision.OldStatus,
+		NewStatus:       revision.NewStatus,
+		OldValue:        revision.OldValue,
+		NewValue:        revision.NewValue,
+		OldPlurals:      revision.OldPlurals,
+		NewPlurals:      revision.NewPlurals,
+		OldPlural:       revision.OldPlural,
+		NewPlural:       revision.NewPlural,
+		OldTags:         revision.OldTags,
+		NewTags:         revision.NewTags,
+	}
+}
+
+func GetHistory(c *gin.Context) {
+	mutationIdParam, err := strconv.ParseUint(c.Param("mutationId"), 10, 32)
+	if err != nil {
+		panic("Mutation ID is not number serializable")
+	}
+
+	// History stays available for mutations in the trash
+	var mutation db.Mutation
+	if err := conn.Unscoped().First(&mutation, uint(mutationIdParam)).Error; err != nil {
+		c.JSON(404, "Mutation does not exist")
+		return
+	}
+
+	userId := c.MustGet("userId").(uint)
+	if !auth.RequestAllowsProject(c, mutation.ProjectID) || !auth.IsUserInProject(userId, mutation.ProjectID) {
+		c.JSON(403, "You are not in this project")
+		return
+	}
+
+	query := conn.Preload("User").Where("mutation_id = ?", mutation.ID)
+	if languageId := c.Query("languageId"); languageId != "" {
+		query = query.Where("language_id = ?", languageId)
+	}
+
+	var revisions []db.Revision
+	query.Order("created_at desc, id desc").Find(&revisions)
+
+	response := make([]RevisionResponse, len(revisions))
+	for i, v := range revisions {
+		response[i] = toRevisionResponse(v)
+	}
+
+	c.JSON(200, response)
+}
+
+// RevertMutationValue restores the value to the state it had right after the given revision
+func RevertMutationValue(c *gin.Context) {
+	mutationValueIdParam, err := strconv.ParseUint(c.Param("mutationValueId"), 10, 32)
+	if err != nil {
+		panic("Mutation Value ID is not number serializable")
+	}
+	revisionIdParam, err := strconv.ParseUint(c.Param("revisionId"), 10, 32)
+	if err != nil {
+		panic("Revision ID is not number serializable")
+	}
+
+	var mutationValue db.MutationValue
+	if err := conn.First(&mutationValue, uint(mutationValueIdParam)).Error; err != nil {
+		c.JSON(404, "Mutation value does not exist")
+		return
+	}
+
+	var foundMutation db.Mutation
+	conn.First(&foundMutation, mutationValue.MutationId)
+
+	userId := c.MustGet("userId").(uint)
+	if !auth.RequestAllowsProject(c, foundMutation.ProjectID) || !auth.CanInProject(userId, foundMutation.ProjectID, auth.PermissionValuesWrite) {
+		c.JSON(403, "You are not allowed to edit translations in this project")
+		return
+	}
+
+	if !auth.GetLanguageAccess(userId, foundMutation.ProjectID).IsLanguageAllowed(mutationValue.LanguageId) {
+		c.JSON(403, "You are not allowed to edit this language")
+		return
+	}
+
+	if auth.IsProjectArchived(foundMutation.ProjectID) {
+		c.JSON(403, "This project is archived and read-only")
+		return
+	}
+
+	var revision db.Revision
+	err = conn.Where("mutation_value_id = ?", mutationValue.ID).First(&revision, uint(revisionIdParam)).Error
+	if err != nil {
+		c.JSON(404, "Revision does not belong to this mutation value")
+		return
+	}
+
+	// Reverting must not skip the review, so the status change follows the workflow
+	role, _ := auth.ProjectRole(userId, foundMutation.ProjectID)
+	if !checkStatus(c, workflow.ForProject(foundMutation.ProjectID), role, mutationValue.Status, revision.NewStatus) {
+		return
+	}
+
+	oldMutationValue := mutationValue
+	mutationValue.Value = revision.NewValue
+	mutationValue.Status = revision.NewStatus
+	mutationValue.Plurals = revision.NewPlurals
+
+	mutationValue.ClearOutdated()
+
+	err = conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&mutationValue).Error; err != nil {
+			return err
+		}
+		if err := history.RecordMutationValue(tx, userId, history.ActionRevert, &oldMutationValue, mutationValue); err != nil {
+			return err
+		}
+		return workflow.MarkOutdated(tx, userId, oldMutationValue, mutationValue)
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error reverting value", "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, mutationValue.ToSimpleMutationValue())
+}
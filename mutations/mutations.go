@@ -1,11 +1,19 @@
 package mutations
 
 import (
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 	"languageboostergo/auth"
 	"languageboostergo/db"
+	"languageboostergo/history"
+	"languageboostergo/keys"
+	"languageboostergo/plurals"
+	"languageboostergo/workflow"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 var conn = db.GetDb()
@@ -14,40 +22,149 @@ type CreateMutationDto struct {
 	ProjectId uint                     `json:"projectId" binding:"required"`
 	Key       string                   `json:"key" binding:"required"`
 	Status    string                   `json:"status" binding:"required"`
+	Plural    bool                     `json:"plural"`
+	Tags      []string                 `json:"tags"`
 	Values    []CreateMutationDtoValue `json:"values" binding:"required"`
 }
 
 type CreateMutationDtoValue struct {
-	LanguageId uint   `json:"languageId" binding:"required"`
-	Value      string `json:"value" binding:"required"`
-	Status     string `json:"status" binding:"required"`
+	LanguageId uint           `json:"languageId" binding:"required"`
+	Value      string         `json:"value" binding:"required"`
+	Status     string         `json:"status" binding:"required"`
+	Plurals    db.PluralForms `json:"plurals"`
 }
 
 type UpdateMutationDto struct {
 	Key    string `json:"key"`
 	Status string `json:"status"`
+	Plural *bool  `json:"plural"`
+	// Tags replace the tags of the mutation, an empty list removes them
+	Tags *[]string `json:"tags"`
 }
 
 type UpdateMutationValueDto struct {
-	Value  string `json:"value"`
-	Status string `json:"status"`
+	Value   string         `json:"value"`
+	Status  string         `json:"status"`
+	Plurals db.PluralForms `json:"plurals"`
 }
 
 type CreateMutationValueDto struct {
-	Value      string `json:"value"`
-	MutationId uint   `json:"mutationId"`
-	LanguageId uint   `json:"languageId"`
+	Value      string         `json:"value"`
+	MutationId uint           `json:"mutationId"`
+	LanguageId uint           `json:"languageId"`
+	Status     string         `json:"status"`
+	Plurals    db.PluralForms `json:"plurals"`
+}
+
+// findKeyCollisions returns existing keys of the project which would collide with the given key,
+// either as its namespace or as a key nested under it
+func findKeyCollisions(projectId uint, key string, excludeId uint) []keys.Collision {
+	var mutations []db.Mutation
+	query := conn.Where("project_id = ? AND id <> ?", projectId, excludeId)
+	prefixes := keys.Prefixes(key)
+	if len(prefixes) > 0 {
+		query = query.Where(conn.Where("key IN ?", prefixes).Or("key LIKE ?", keys.EscapeLike(key)+".%"))
+	} else {
+		query = query.Where("key LIKE ?", keys.EscapeLike(key)+".%")
+	}
+	query.Find(&mutations)
+
+	collisions := []keys.Collision{}
+	for _, mutation := range mutations {
+		if len(mutation.Key) < len(key) {
+			collisions = append(collisions, keys.Collision{Namespace: mutation.Key, Key: key})
+		} else {
+			collisions = append(collisions, keys.Collision{Namespace: key, Key: mutation.Key})
+		}
+	}
+	return collisions
 }
 
-type SearchMutationLanguageDto struct {
-	LanguageId uint   `json:"languageId" binding:"required"`
-	Search     string `json:"search" binding:"required"`
+// applyPlurals sets the plural forms of the value and validates it against its mutation,
+// the other form is mirrored into Value for consumers which are not aware of plurals
+func applyPlurals(plural bool, mutationValue *db.MutationValue, forms db.PluralForms) error {
+	if len(forms) > 0 {
+		if !plural {
+			return errors.New("plural forms are only allowed on plural mutations")
+		}
+		mutationValue.Plurals = forms
+		mutationValue.Value = forms[plurals.Other]
+	}
+	return validatePlurals(plural, *mutationValue)
 }
 
-type SearchMutationsDto struct {
-	Key       string                      `json:"key"`
-	Status    string                      `json:"status"`
-	Languages []SearchMutationLanguageDto `json:"languages"`
+// validatePlurals checks the value fits the plural flag of its mutation, values of plural
+// mutations need every CLDR category of their language unless they are still empty
+func validatePlurals(plural bool, mutationValue db.MutationValue) error {
+	if !plural {
+		if len(mutationValue.Plurals) > 0 {
+			return errors.New("plural forms are only allowed on plural mutations")
+		}
+		return nil
+	}
+
+	if len(mutationValue.Plurals) == 0 {
+		if mutationValue.Value == "" {
+			return nil
+		}
+		return errors.New("values of plural mutations need plural forms")
+	}
+	if mutationValue.Value != mutationValue.Plurals[plurals.Other] {
+		return errors.New("values of plural mutations are changed through their plural forms")
+	}
+
+	var language db.Language
+	if err := conn.First(&language, mutationValue.LanguageId).Error; err != nil {
+		return errors.New("language does not exist")
+	}
+
+	ruleSet := plurals.ForLanguage(language.PluralRules, language.Code)
+	if missing := ruleSet.Missing(mutationValue.Plurals); len(missing) > 0 {
+		return fmt.Errorf("missing plural categories: %s", strings.Join(missing, ", "))
+	}
+	if unknown := ruleSet.Unknown(mutationValue.Plurals); len(unknown) > 0 {
+		return fmt.Errorf("plural categories not used by this language: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// checkStatus validates a status change against the project workflow and the role of the user
+func checkStatus(c *gin.Context, projectWorkflow workflow.Workflow, role, from, to string) bool {
+	if err := projectWorkflow.Check(role, from, to); err != nil {
+		c.JSON(workflow.StatusCode(err), gin.H{"message": workflow.Error(err, from, to)})
+		return false
+	}
+	return true
+}
+
+// checkInitialStatus validates the status of a new mutation or value against the project workflow
+func checkInitialStatus(c *gin.Context, projectWorkflow workflow.Workflow, role, status string) bool {
+	if err := projectWorkflow.CheckInitial(role, status); err != nil {
+		c.JSON(workflow.StatusCode(err), gin.H{"message": workflow.Error(err, projectWorkflow.Initial, status)})
+		return false
+	}
+	return true
+}
+
+func LintByProject(c *gin.Context) {
+	projectIdParam, err := strconv.ParseUint(c.Param("projectId"), 10, 32)
+	if err != nil {
+		c.JSON(405, "Project ID is invalid")
+		return
+	}
+
+	projectId := uint(projectIdParam)
+	userId := c.MustGet("userId").(uint)
+
+	if !auth.RequestAllowsProject(c, projectId) || !auth.IsUserInProject(userId, projectId) {
+		c.JSON(403, "You are not in this project")
+		return
+	}
+
+	var projectKeys []string
+	conn.Model(&db.Mutation{}).Where("project_id = ?", projectId).Pluck("key", &projectKeys)
+
+	c.JSON(200, gin.H{"collisions": keys.FindCollisions(projectKeys)})
 }
 
 func CreateMutationValue(c *gin.Context) {
@@ -62,8 +179,23 @@ func CreateMutationValue(c *gin.Context) {
 
 	userId := c.MustGet("userId").(uint)
 
-	if !auth.IsUserInProject(userId, foundMutation.ProjectID) {
-		c.JSON(403, "You are not in this project")
+	if !auth.RequestAllowsProject(c, foundMutation.ProjectID) || !auth.CanInProject(userId, foundMutation.ProjectID, auth.PermissionValuesWrite) {
+		c.JSON(403, "You are not allowed to edit translations in this project")
+		return
+	}
+
+	if !auth.GetLanguageAccess(userId, foundMutation.ProjectID).IsLanguageAllowed(request.LanguageId) {
+		c.JSON(403, "You are not allowed to edit this language")
+		return
+	}
+
+	if auth.IsProjectArchived(foundMutation.ProjectID) {
+		c.JSON(403, "This project is archived and read-only")
+		return
+	}
+
+	role, _ := auth.ProjectRole(userId, foundMutation.ProjectID)
+	if !checkInitialStatus(c, workflow.ForProject(foundMutation.ProjectID), role, request.Status) {
 		return
 	}
 
@@ -71,8 +203,23 @@ func CreateMutationValue(c *gin.Context) {
 	newMutationValue.Value = request.Value
 	newMutationValue.LanguageId = request.LanguageId
 	newMutationValue.MutationId = request.MutationId
+	newMutationValue.Status = request.Status
 
-	conn.Create(&newMutationValue)
+	if err := applyPlurals(foundMutation.Plural, &newMutationValue, request.Plurals); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&newMutationValue).Error; err != nil {
+			return err
+		}
+		return history.RecordMutationValue(tx, userId, history.ActionCreate, nil, newMutationValue)
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error creating value", "error": err.Error()})
+		return
+	}
 	c.JSON(200, newMutationValue.ToSimpleMutationValue())
 }
 
@@ -94,8 +241,13 @@ func UpdateMutation(c *gin.Context) {
 
 	userId := c.MustGet("userId").(uint)
 
-	if !auth.IsUserInProject(userId, updatedMutation.ProjectID) {
-		c.JSON(403, "You are not in this project")
+	if !auth.RequestAllowsProject(c, updatedMutation.ProjectID) || !auth.CanInProject(userId, updatedMutation.ProjectID, auth.PermissionKeysWrite) {
+		c.JSON(403, "You are not allowed to edit keys in this project")
+		return
+	}
+
+	if auth.IsProjectArchived(updatedMutation.ProjectID) {
+		c.JSON(403, "This project is archived and read-only")
 		return
 	}
 
@@ -108,15 +260,60 @@ func UpdateMutation(c *gin.Context) {
 		return
 	}
 
+	oldMutation := updatedMutation
+
 	if request.Key != "" {
+		if collisions := findKeyCollisions(updatedMutation.ProjectID, request.Key, updatedMutation.ID); len(collisions) > 0 {
+			c.JSON(409, gin.H{"message": "Key collides with existing keys", "collisions": collisions})
+			return
+		}
 		updatedMutation.Key = request.Key
 	}
 
 	if request.Status != "" {
+		role, _ := auth.ProjectRole(userId, updatedMutation.ProjectID)
+		if !checkStatus(c, workflow.ForProject(updatedMutation.ProjectID), role, updatedMutation.Status, request.Status) {
+			return
+		}
 		updatedMutation.Status = request.Status
 	}
 
-	conn.Save(&updatedMutation)
+	if request.Plural != nil && *request.Plural != updatedMutation.Plural {
+		// Existing values have to fit the new flag, they are not converted
+		var values []db.MutationValue
+		conn.Where("mutation_id = ?", updatedMutation.ID).Find(&values)
+		invalid := []gin.H{}
+		for _, value := range values {
+			if err := validatePlurals(*request.Plural, value); err != nil {
+				invalid = append(invalid, gin.H{"languageId": value.LanguageId, "error": err.Error()})
+			}
+		}
+		if len(invalid) > 0 {
+			c.JSON(409, gin.H{"message": "Existing values do not fit the plural setting", "values": invalid})
+			return
+		}
+		updatedMutation.Plural = *request.Plural
+	}
+
+	if request.Tags != nil {
+		tags, err := normalizeTags(*request.Tags)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		updatedMutation.Tags = tags
+	}
+
+	err = conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&updatedMutation).Error; err != nil {
+			return err
+		}
+		return history.RecordMutation(tx, userId, history.ActionUpdate, &oldMutation, updatedMutation)
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error updating mutation", "error": err.Error()})
+		return
+	}
 	c.JSON(200, updatedMutation.ToSimpleMutation())
 }
 
@@ -132,7 +329,7 @@ func GetById(c *gin.Context) {
 
 	userId := c.MustGet("userId").(uint)
 
-	if !auth.IsUserInProject(userId, mutation.ProjectID) {
+	if !auth.RequestAllowsProject(c, mutation.ProjectID) || !auth.IsUserInProject(userId, mutation.ProjectID) {
 		c.JSON(403, "You are not in this project")
 		return
 	}
@@ -143,7 +340,9 @@ func GetById(c *gin.Context) {
 		return
 	}
 
-	c.JSON(200, mutation.ToSimpleMutation())
+	simpleMutations := []db.SimpleMutation{mutation.ToSimpleMutation()}
+	auth.GetLanguageAccess(userId, mutation.ProjectID).MarkEditable(simpleMutations)
+	c.JSON(200, simpleMutations[0])
 }
 
 func DeleteById(c *gin.Context) {
@@ -157,80 +356,31 @@ func DeleteById(c *gin.Context) {
 	conn.First(&mutation, mutationId)
 
 	userId := c.MustGet("userId").(uint)
-	if !auth.IsUserInProject(userId, mutation.ProjectID) {
-		c.JSON(403, "You are not in this project")
+	if !auth.RequestAllowsProject(c, mutation.ProjectID) || !auth.CanInProject(userId, mutation.ProjectID, auth.PermissionKeysWrite) {
+		c.JSON(403, "You are not allowed to edit keys in this project")
 		return
 	}
 
-	conn.Delete(&mutation)
-	c.JSON(200, mutation)
-}
-
-func SearchByProject(c *gin.Context) {
-	projectIdParam, err := strconv.ParseUint(c.Param("projectId"), 10, 32)
-	if err != nil {
-		c.JSON(405, "Project ID is invalid")
+	if auth.IsProjectArchived(mutation.ProjectID) {
+		c.JSON(403, "This project is archived and read-only")
 		return
 	}
 
-	projectId := uint(projectIdParam)
-
-	userId := c.MustGet("userId").(uint)
-
-	if !auth.IsUserInProject(userId, projectId) {
-		c.JSON(403, "You are not in this project")
-		return
-	}
-
-	var request SearchMutationsDto
-	if err := c.ShouldBindJSON(&request); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	mvDb := conn
-	for _, lang := range request.Languages {
-		mvDb = mvDb.Or("language_id = ? AND value LIKE ?", lang.LanguageId, "%"+lang.Search+"%")
-	}
-
-	var mutationValues []db.MutationValue
-	mvDb.Select("mutation_id").Find(&mutationValues)
-
-	var mutationIds []uint
-	uniqueIds := make(map[uint]bool)
-
-	for _, value := range mutationValues {
-		if _, exists := uniqueIds[value.MutationId]; !exists {
-			mutationIds = append(mutationIds, value.MutationId)
-			uniqueIds[value.MutationId] = true
+	// The mutation is moved to the trash together with its values
+	err = conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("mutation_id = ?", mutation.ID).Delete(&db.MutationValue{}).Error; err != nil {
+			return err
 		}
-	}
-
-	if len(mutationIds) == 0 {
-		var res []db.SimpleMutation
-		c.JSON(200, res)
+		if err := tx.Delete(&mutation).Error; err != nil {
+			return err
+		}
+		return history.RecordMutation(tx, userId, history.ActionDelete, &mutation, mutation)
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error deleting mutation", "error": err.Error()})
 		return
 	}
-
-	var mutations []db.Mutation
-	resDb := conn.Preload("MutationValues").Order("key asc").Where(mutationIds).Where("project_id = ?", projectId)
-
-	if request.Key != "" {
-		resDb.Where("key like ?", "%"+request.Key+"%")
-	}
-
-	if request.Status != "" {
-		resDb.Where("status = ?", request.Status)
-	}
-
-	resDb.Limit(100).Find(&mutations)
-
-	simpleMutations := make([]db.SimpleMutation, len(mutations))
-	for i, v := range mutations {
-		simpleMutations[i] = v.ToSimpleMutation()
-	}
-
-	c.JSON(200, simpleMutations)
+	c.JSON(200, mutation)
 }
 
 func ListByProject(c *gin.Context) {
@@ -243,18 +393,24 @@ func ListByProject(c *gin.Context) {
 
 	userId := c.MustGet("userId").(uint)
 
-	if !auth.IsUserInProject(userId, projectId) {
+	if !auth.RequestAllowsProject(c, projectId) || !auth.IsUserInProject(userId, projectId) {
 		c.JSON(403, "You are not in this project")
 		return
 	}
 
-	var mutations []db.Mutation
-	conn.Preload("MutationValues").Order("key asc").Limit(100).Find(&mutations, "mutations.project_id = ?", projectId)
-	simpleMutations := make([]db.SimpleMutation, len(mutations))
-	for i, v := range mutations {
-		simpleMutations[i] = v.ToSimpleMutation()
+	params, err := parsePageParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	c.JSON(200, simpleMutations)
+
+	page, err := paginateMutations(conn.Where("mutations.project_id = ?", projectId), params)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	auth.GetLanguageAccess(userId, projectId).MarkEditable(page.Items)
+	c.JSON(200, page)
 }
 
 func UpdateMutationValue(c *gin.Context) {
@@ -278,20 +434,70 @@ func UpdateMutationValue(c *gin.Context) {
 
 	userId := c.MustGet("userId").(uint)
 
-	if !auth.IsUserInProject(userId, foundMutation.ProjectID) {
-		c.JSON(403, "You are not in this project")
+	// Reviewers may change only the status of a value
+	role, _ := auth.ProjectRole(userId, foundMutation.ProjectID)
+	statusOnly := request.Value == "" && len(request.Plurals) == 0
+	canChange := auth.Can(role, auth.PermissionValuesWrite) || (statusOnly && auth.Can(role, auth.PermissionValuesReview))
+	if !auth.RequestAllowsProject(c, foundMutation.ProjectID) || !canChange {
+		c.JSON(403, "You are not allowed to edit translations in this project")
+		return
+	}
+
+	if !auth.GetLanguageAccess(userId, foundMutation.ProjectID).IsLanguageAllowed(updatedMutationValue.LanguageId) {
+		c.JSON(403, "You are not allowed to edit this language")
 		return
 	}
 
+	if auth.IsProjectArchived(foundMutation.ProjectID) {
+		c.JSON(403, "This project is archived and read-only")
+		return
+	}
+
+	oldMutationValue := updatedMutationValue
+
 	if request.Value != "" {
 		updatedMutationValue.Value = request.Value
 	}
 
+	projectWorkflow := workflow.ForProject(foundMutation.ProjectID)
 	if request.Status != "" {
+		if !checkStatus(c, projectWorkflow, role, updatedMutationValue.Status, request.Status) {
+			return
+		}
 		updatedMutationValue.Status = request.Status
 	}
 
-	conn.Save(&updatedMutationValue)
+	if err := applyPlurals(foundMutation.Plural, &updatedMutationValue, request.Plurals); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	// Edited text is no longer what was approved
+	textChanged := updatedMutationValue.Value != oldMutationValue.Value || !history.SamePlurals(updatedMutationValue.Plurals, oldMutationValue.Plurals)
+	if request.Status == "" && textChanged {
+		status, err := projectWorkflow.EditedStatus(role, updatedMutationValue.Status)
+		if err != nil {
+			c.JSON(workflow.StatusCode(err), gin.H{"message": "The workflow does not allow editing approved values: " + err.Error()})
+			return
+		}
+		updatedMutationValue.Status = status
+	}
+
+	updatedMutationValue.ClearOutdated()
+
+	err = conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&updatedMutationValue).Error; err != nil {
+			return err
+		}
+		if err := history.RecordMutationValue(tx, userId, history.ActionUpdate, &oldMutationValue, updatedMutationValue); err != nil {
+			return err
+		}
+		return workflow.MarkOutdated(tx, userId, oldMutationValue, updatedMutationValue)
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error updating value", "error": err.Error()})
+		return
+	}
 
 	c.JSON(200, updatedMutationValue.ToSimpleMutationValue())
 }
@@ -304,8 +510,21 @@ func CreateMutation(c *gin.Context) {
 	}
 
 	userId := c.MustGet("userId").(uint)
-	if !auth.IsUserInProject(userId, data.ProjectId) {
-		c.JSON(403, "You are not in this project")
+	if !auth.RequestAllowsProject(c, data.ProjectId) || !auth.CanInProject(userId, data.ProjectId, auth.PermissionKeysWrite) {
+		c.JSON(403, "You are not allowed to edit keys in this project")
+		return
+	}
+
+	languageAccess := auth.GetLanguageAccess(userId, data.ProjectId)
+	for _, value := range data.Values {
+		if !languageAccess.IsLanguageAllowed(value.LanguageId) {
+			c.JSON(403, gin.H{"message": "You are not allowed to edit this language", "languageId": value.LanguageId})
+			return
+		}
+	}
+
+	if auth.IsProjectArchived(data.ProjectId) {
+		c.JSON(403, "This project is archived and read-only")
 		return
 	}
 
@@ -317,6 +536,29 @@ func CreateMutation(c *gin.Context) {
 		return
 	}
 
+	if collisions := findKeyCollisions(data.ProjectId, data.Key, 0); len(collisions) > 0 {
+		c.JSON(409, gin.H{"message": "Key collides with existing keys", "collisions": collisions})
+		return
+	}
+
+	tags, err := normalizeTags(data.Tags)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	// New statuses are checked as changes from the initial status of the workflow
+	role, _ := auth.ProjectRole(userId, data.ProjectId)
+	projectWorkflow := workflow.ForProject(data.ProjectId)
+	if !checkInitialStatus(c, projectWorkflow, role, data.Status) {
+		return
+	}
+	for _, value := range data.Values {
+		if !checkInitialStatus(c, projectWorkflow, role, value.Status) {
+			return
+		}
+	}
+
 	// Mutation does not exist yet
 	// Get languages by project
 	var languages []db.Language
@@ -340,6 +582,10 @@ func CreateMutation(c *gin.Context) {
 				Value:      foundValue.Value,
 				Status:     foundValue.Status,
 			}
+			if err := applyPlurals(data.Plural, &mutationValues[i], foundValue.Plurals); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"message": err.Error(), "languageId": language.ID})
+				return
+			}
 		} else {
 			mutationValues[i] = db.MutationValue{
 				LanguageId: language.ID,
@@ -353,10 +599,29 @@ func CreateMutation(c *gin.Context) {
 		ProjectID:      data.ProjectId,
 		Status:         data.Status,
 		Key:            data.Key,
+		Plural:         data.Plural,
+		Tags:           tags,
 		MutationValues: mutationValues,
 	}
 
-	conn.Create(&mutation)
+	err = conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&mutation).Error; err != nil {
+			return err
+		}
+		if err := history.RecordMutation(tx, userId, history.ActionCreate, nil, mutation); err != nil {
+			return err
+		}
+		for _, value := range mutation.MutationValues {
+			if err := history.RecordMutationValue(tx, userId, history.ActionCreate, nil, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error creating mutation", "error": err.Error()})
+		return
+	}
 
 	c.JSON(200, mutation.ToSimpleMutation())
 }
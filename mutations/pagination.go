@@ -0,0 +1,169 @@
+package mutations
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"languageboostergo/db"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// sortColumns maps the sort parameter to the column, the ID breaks ties so the order is stable
+var sortColumns = map[string]string{
+	"key":       "mutations.key",
+	"updatedAt": "mutations.updated_at",
+	"status":    "mutations.status",
+}
+
+// PageParams are read from the limit, sort, order and cursor query parameters
+type PageParams struct {
+	Limit  int
+	Sort   string
+	Order  string
+	cursor *pageCursor
+}
+
+// pageCursor points behind the last mutation of the previous page,
+// the sort and order are part of it so a cursor cannot be reused for a different sorting
+type pageCursor struct {
+	Sort  string `json:"s"`
+	Order string `json:"o"`
+	Value string `json:"v"`
+	ID    uint   `json:"id"`
+}
+
+// MutationPage is the envelope of every paginated mutation listing
+type MutationPage struct {
+	Items      []db.SimpleMutation `json:"items"`
+	Total      int64               `json:"total"`
+	Limit      int                 `json:"limit"`
+	Sort       string              `json:"sort"`
+	Order      string              `json:"order"`
+	NextCursor string              `json:"nextCursor,omitempty"`
+}
+
+func emptyPage(params PageParams) MutationPage {
+	return MutationPage{Items: []db.SimpleMutation{}, Limit: params.Limit, Sort: params.Sort, Order: params.Order}
+}
+
+func parsePageParams(c *gin.Context) (PageParams, error) {
+	params := PageParams{
+		Limit: defaultPageSize,
+		Sort:  c.DefaultQuery("sort", "key"),
+		Order: c.DefaultQuery("order", "asc"),
+	}
+
+	if limitParam := c.Query("limit"); limitParam != "" {
+		limit, err := strconv.Atoi(limitParam)
+		if err != nil || limit <= 0 {
+			return params, errors.New("limit has to be a positive number")
+		}
+		params.Limit = limit
+	}
+	if params.Limit > maxPageSize {
+		params.Limit = maxPageSize
+	}
+
+	if _, ok := sortColumns[params.Sort]; !ok {
+		return params, errors.New("sort has to be key, updatedAt or status")
+	}
+	if params.Order != "asc" && params.Order != "desc" {
+		return params, errors.New("order has to be asc or desc")
+	}
+
+	if cursorParam := c.Query("cursor"); cursorParam != "" {
+		data, err := base64.RawURLEncoding.DecodeString(cursorParam)
+		var cursor pageCursor
+		if err != nil || json.Unmarshal(data, &cursor) != nil {
+			return params, errInvalidCursor
+		}
+		if cursor.Sort != params.Sort || cursor.Order != params.Order {
+			return params, errors.New("cursor belongs to a different sorting")
+		}
+		params.cursor = &cursor
+	}
+
+	return params, nil
+}
+
+func sortValue(mutation db.Mutation, sort string) string {
+	switch sort {
+	case "updatedAt":
+		return mutation.UpdatedAt.Format(time.RFC3339Nano)
+	case "status":
+		return mutation.Status
+	}
+	return mutation.Key
+}
+
+func encodeCursor(cursor pageCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// paginateMutations counts the query and loads one page of it with the values preloaded,
+// the query must not be ordered yet
+// errInvalidCursor is returned for cursors which were not issued by a previous page
+var errInvalidCursor = errors.New("cursor is invalid")
+
+func paginateMutations(query *gorm.DB, params PageParams) (MutationPage, error) {
+	page := emptyPage(params)
+
+	if err := query.Session(&gorm.Session{}).Model(&db.Mutation{}).Count(&page.Total).Error; err != nil {
+		return page, err
+	}
+
+	column := sortColumns[params.Sort]
+	comparison := ">"
+	if params.Order == "desc" {
+		comparison = "<"
+	}
+
+	pageQuery := query.Session(&gorm.Session{})
+	if params.cursor != nil {
+		var value interface{} = params.cursor.Value
+		if params.Sort == "updatedAt" {
+			updatedAt, err := time.Parse(time.RFC3339Nano, params.cursor.Value)
+			if err != nil {
+				return page, errInvalidCursor
+			}
+			value = updatedAt
+		}
+		pageQuery = pageQuery.Where("("+column+", mutations.id) "+comparison+" (?, ?)", value, params.cursor.ID)
+	}
+
+	// One more mutation is loaded to know whether there is a next page
+	var mutations []db.Mutation
+	err := pageQuery.Preload("MutationValues").
+		Order(column + " " + params.Order).
+		Order("mutations.id " + params.Order).
+		Limit(params.Limit + 1).
+		Find(&mutations).Error
+	if err != nil {
+		return page, err
+	}
+
+	if len(mutations) > params.Limit {
+		mutations = mutations[:params.Limit]
+		last := mutations[len(mutations)-1]
+		page.NextCursor = encodeCursor(pageCursor{
+			Sort:  params.Sort,
+			Order: params.Order,
+			Value: sortValue(last, params.Sort),
+			ID:    last.ID,
+		})
+	}
+
+	for _, mutation := range mutations {
+		page.Items = append(page.Items, mutation.ToSimpleMutation())
+	}
+	return page, nil
+}
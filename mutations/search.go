@@ -0,0 +1,306 @@
+package mutations
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+	"languageboostergo/auth"
+	"languageboostergo/keys"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MatchContains = "contains"
+	MatchExact    = "exact"
+	MatchPrefix   = "prefix"
+	MatchRegex    = "regex"
+
+	CombineAny = "any"
+	CombineAll = "all"
+
+	// maxRegexLength caps regular expressions, long patterns are rarely needed and slow to match
+	maxRegexLength = 200
+	// pgInvalidRegex and pgQueryCanceled are the Postgres error codes of an invalid
+	// regular expression and of a statement cancelled by the timeout
+	pgInvalidRegex  = "2201B"
+	pgQueryCanceled = "57014"
+	// searchTimeout bounds the search statements, regular expressions may backtrack for a long time
+	searchTimeout = 5 * time.Second
+)
+
+// errSearchTimeout is returned when the search was cancelled by the statement timeout
+var errSearchTimeout = errors.New("the search took too long, narrow down the filters")
+
+// invalidSearchError is a filter the request got wrong, database failures are never wrapped in it
+type invalidSearchError struct {
+	error
+}
+
+// searchStatus answers 400 for invalid filters, 503 when the search timed out and 500 for database failures
+func searchStatus(err error) int {
+	var invalid invalidSearchError
+	switch {
+	case errors.As(err, &invalid), errors.Is(err, errInvalidCursor):
+		return http.StatusBadRequest
+	case errors.Is(err, errSearchTimeout):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// SearchMutationLanguageDto filters by the value of one language, all given conditions
+// have to hold for the same value. Empty matches missing and empty values
+type SearchMutationLanguageDto struct {
+	LanguageId uint   `json:"languageId" binding:"required"`
+	Search     string `json:"search"`
+	Mode       string `json:"mode"`
+	Status     string `json:"status"`
+	Empty      *bool  `json:"empty"`
+}
+
+type SearchMutationsDto struct {
+	Key     string `json:"key"`
+	KeyMode string `json:"keyMode"`
+	Status  string `json:"status"`
+	// Tags matches mutations carrying all of the tags
+	Tags []string `json:"tags"`
+	// Combine joins the language filters with "any" (OR, default) or "all" (AND)
+	Combine       string                      `json:"combine"`
+	CaseSensitive bool                        `json:"caseSensitive"`
+	Languages     []SearchMutationLanguageDto `json:"languages"`
+	// UpdatedBy matches mutations changed by the user, within the date range when it is given
+	UpdatedBy   uint       `json:"updatedBy"`
+	UpdatedFrom *time.Time `json:"updatedFrom"`
+	UpdatedTo   *time.Time `json:"updatedTo"`
+}
+
+// textCondition builds the SQL matching the column, LIKE patterns are escaped
+// and case-insensitive matching uses ILIKE so the trigram indexes apply
+func textCondition(column, mode, search string, caseSensitive bool) (string, interface{}, error) {
+	like := "ILIKE"
+	if caseSensitive {
+		like = "LIKE"
+	}
+	switch mode {
+	case "", MatchContains:
+		return column + " " + like + " ?", "%" + keys.EscapeLike(search) + "%", nil
+	case MatchPrefix:
+		return column + " " + like + " ?", keys.EscapeLike(search) + "%", nil
+	case MatchExact:
+		if caseSensitive {
+			return column + " = ?", search, nil
+		}
+		return column + " ILIKE ?", keys.EscapeLike(search), nil
+	case MatchRegex:
+		// Postgres compiles the pattern, an invalid one fails the search statement
+		if len(search) > maxRegexLength {
+			return "", nil, fmt.Errorf("regular expression is longer than %d characters", maxRegexLength)
+		}
+		if caseSensitive {
+			return column + " ~ ?", search, nil
+		}
+		return column + " ~* ?", search, nil
+	}
+	return "", nil, fmt.Errorf("unknown match mode %q, use contains, exact, prefix or regex", mode)
+}
+
+// runSearch runs the search statements in a transaction limited by the search timeout
+func runSearch(search func(tx *gorm.DB) error) error {
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(fmt.Sprintf("SET LOCAL statement_timeout = %d", searchTimeout.Milliseconds())).Error; err != nil {
+			return err
+		}
+		return search(tx)
+	})
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case pgQueryCanceled:
+			return errSearchTimeout
+		case pgInvalidRegex:
+			return invalidSearchError{fmt.Errorf("invalid regular expression: %s", pgErr.Message)}
+		}
+	}
+	return err
+}
+
+// languageCondition builds an EXISTS over the values of the mutation in the language
+func languageCondition(filter SearchMutationLanguageDto, caseSensitive bool) (string, []interface{}, error) {
+	conditions := []string{"mv.mutation_id = mutations.id", "mv.deleted_at IS NULL", "mv.language_id = ?"}
+	args := []interface{}{filter.LanguageId}
+
+	if filter.Empty != nil {
+		if filter.Search != "" {
+			return "", nil, errors.New("empty cannot be combined with search")
+		}
+		if filter.Status != "" {
+			return "", nil, errors.New("empty cannot be combined with status")
+		}
+		// A missing value is empty too, so empty values are found as the absence of a filled one,
+		// plural values count as filled when they have forms
+		conditions = append(conditions, "(mv.value <> '' OR mv.plurals IS NOT NULL AND mv.plurals <> '{}'::jsonb)")
+		exists := "EXISTS (SELECT 1 FROM mutation_values mv WHERE " + strings.Join(conditions, " AND ") + ")"
+		if *filter.Empty {
+			return "NOT " + exists, args, nil
+		}
+		return exists, args, nil
+	}
+
+	if filter.Search == "" && filter.Status == "" {
+		return "", nil, errors.New("language filter needs search, status or empty")
+	}
+
+	if filter.Search != "" {
+		condition, arg, err := textCondition("mv.value", filter.Mode, filter.Search, caseSensitive)
+		if err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions, condition)
+		args = append(args, arg)
+	}
+	if filter.Status != "" {
+		conditions = append(conditions, "mv.status = ?")
+		args = append(args, filter.Status)
+	}
+
+	return "EXISTS (SELECT 1 FROM mutation_values mv WHERE " + strings.Join(conditions, " AND ") + ")", args, nil
+}
+
+// searchQuery builds the query of the search filters, every filter is scoped to the project
+// and all filters are combined with AND, only the language filters may be combined with OR.
+// Its errors are invalid filters
+func searchQuery(tx *gorm.DB, projectId uint, request SearchMutationsDto) (*gorm.DB, error) {
+	query, err := buildSearchQuery(tx, projectId, request)
+	if err != nil {
+		return nil, invalidSearchError{err}
+	}
+	return query, nil
+}
+
+func buildSearchQuery(tx *gorm.DB, projectId uint, request SearchMutationsDto) (*gorm.DB, error) {
+	query := tx.Where("mutations.project_id = ?", projectId)
+
+	if request.Key != "" {
+		condition, arg, err := textCondition("mutations.key", request.KeyMode, request.Key, request.CaseSensitive)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where(condition, arg)
+	}
+
+	if request.Status != "" {
+		query = query.Where("mutations.status = ?", request.Status)
+	}
+
+	if len(request.Tags) > 0 {
+		tags, err := json.Marshal(request.Tags)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where("mutations.tags @> ?::jsonb", string(tags))
+	}
+
+	if len(request.Languages) > 0 {
+		separator := " OR "
+		switch request.Combine {
+		case "", CombineAny:
+		case CombineAll:
+			separator = " AND "
+		default:
+			return nil, errors.New("combine has to be any or all")
+		}
+
+		conditions := make([]string, len(request.Languages))
+		var args []interface{}
+		for i, filter := range request.Languages {
+			condition, conditionArgs, err := languageCondition(filter, request.CaseSensitive)
+			if err != nil {
+				return nil, fmt.Errorf("language %d: %w", filter.LanguageId, err)
+			}
+			conditions[i] = condition
+			args = append(args, conditionArgs...)
+		}
+		query = query.Where("("+strings.Join(conditions, separator)+")", args...)
+	}
+
+	if request.UpdatedBy != 0 {
+		conditions := []string{"r.mutation_id = mutations.id", "r.user_id = ?"}
+		args := []interface{}{request.UpdatedBy}
+		if request.UpdatedFrom != nil {
+			conditions = append(conditions, "r.created_at >= ?")
+			args = append(args, *request.UpdatedFrom)
+		}
+		if request.UpdatedTo != nil {
+			conditions = append(conditions, "r.created_at <= ?")
+			args = append(args, *request.UpdatedTo)
+		}
+		query = query.Where("EXISTS (SELECT 1 FROM revisions r WHERE "+strings.Join(conditions, " AND ")+")", args...)
+	} else if request.UpdatedFrom != nil || request.UpdatedTo != nil {
+		// A mutation counts as updated when the key or any of its values changed
+		from, to := time.Time{}, time.Now().AddDate(100, 0, 0)
+		if request.UpdatedFrom != nil {
+			from = *request.UpdatedFrom
+		}
+		if request.UpdatedTo != nil {
+			to = *request.UpdatedTo
+		}
+		query = query.Where(
+			"(mutations.updated_at BETWEEN ? AND ? OR EXISTS (SELECT 1 FROM mutation_values mv WHERE mv.mutation_id = mutations.id AND mv.deleted_at IS NULL AND mv.updated_at BETWEEN ? AND ?))",
+			from, to, from, to,
+		)
+	}
+
+	return query, nil
+}
+
+func SearchByProject(c *gin.Context) {
+	projectIdParam, err := strconv.ParseUint(c.Param("projectId"), 10, 32)
+	if err != nil {
+		c.JSON(405, "Project ID is invalid")
+		return
+	}
+
+	projectId := uint(projectIdParam)
+
+	userId := c.MustGet("userId").(uint)
+
+	if !auth.RequestAllowsProject(c, projectId) || !auth.IsUserInProject(userId, projectId) {
+		c.JSON(403, "You are not in this project")
+		return
+	}
+
+	var request SearchMutationsDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	params, err := parsePageParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var page MutationPage
+	err = runSearch(func(tx *gorm.DB) error {
+		query, err := searchQuery(tx, projectId, request)
+		if err != nil {
+			return err
+		}
+		page, err = paginateMutations(query, params)
+		return err
+	})
+	if err != nil {
+		c.JSON(searchStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	auth.GetLanguageAccess(userId, projectId).MarkEditable(page.Items)
+
+	c.JSON(200, page)
+}
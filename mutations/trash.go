@@ -0,0 +1,190 @@
+package mutations
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"languageboostergo/auth"
+	"languageboostergo/db"
+	"languageboostergo/history"
+	"os"
+	"strconv"
+	"time"
+)
+
+const defaultTrashRetentionDays = 30
+
+type TrashedMutation struct {
+	db.SimpleMutation
+	DeletedAt time.Time `json:"deletedAt"`
+	PurgeAt   time.Time `json:"purgeAt"`
+}
+
+// trashRetention is read from TRASH_RETENTION_DAYS, mutations older than that are purged
+func trashRetention() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("TRASH_RETENTION_DAYS"))
+	if err != nil || days <= 0 {
+		days = defaultTrashRetentionDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// findTrashed loads a soft deleted mutation and checks the user can access its project
+func findTrashed(c *gin.Context) (db.Mutation, bool) {
+	mutationIdParam, err := strconv.ParseUint(c.Param("mutationId"), 10, 32)
+	if err != nil {
+		panic("Mutation ID is not number serializable")
+	}
+
+	var mutation db.Mutation
+	err = conn.Unscoped().Where("deleted_at IS NOT NULL").First(&mutation, uint(mutationIdParam)).Error
+	if err != nil {
+		c.JSON(404, "Mutation is not in the trash")
+		return mutation, false
+	}
+
+	userId := c.MustGet("userId").(uint)
+	if !auth.RequestAllowsProject(c, mutation.ProjectID) || !auth.CanInProject(userId, mutation.ProjectID, auth.PermissionKeysWrite) {
+		c.JSON(403, "You are not allowed to edit keys in this project")
+		return mutation, false
+	}
+
+	if auth.IsProjectArchived(mutation.ProjectID) {
+		c.JSON(403, "This project is archived and read-only")
+		return mutation, false
+	}
+
+	return mutation, true
+}
+
+func ListTrashByProject(c *gin.Context) {
+	projectIdParam, err := strconv.ParseUint(c.Param("projectId"), 10, 32)
+	if err != nil {
+		c.JSON(405, "Project ID is invalid")
+		return
+	}
+
+	projectId := uint(projectIdParam)
+	userId := c.MustGet("userId").(uint)
+
+	if !auth.RequestAllowsProject(c, projectId) || !auth.IsUserInProject(userId, projectId) {
+		c.JSON(403, "You are not in this project")
+		return
+	}
+
+	var mutations []db.Mutation
+	conn.Unscoped().
+		Preload("MutationValues", func(tx *gorm.DB) *gorm.DB { return tx.Unscoped() }).
+		Where("project_id = ? AND deleted_at IS NOT NULL", projectId).
+		Order("deleted_at desc").
+		Find(&mutations)
+
+	retention := trashRetention()
+	trashed := make([]TrashedMutation, len(mutations))
+	for i, v := range mutations {
+		trashed[i] = TrashedMutation{
+			SimpleMutation: v.ToSimpleMutation(),
+			DeletedAt:      v.DeletedAt.Time,
+			PurgeAt:        v.DeletedAt.Time.Add(retention),
+		}
+	}
+
+	c.JSON(200, trashed)
+}
+
+func RestoreFromTrash(c *gin.Context) {
+	mutation, ok := findTrashed(c)
+	if !ok {
+		return
+	}
+
+	var existing int64
+	conn.Model(&db.Mutation{}).Where("project_id = ? AND key = ?", mutation.ProjectID, mutation.Key).Count(&existing)
+	if existing > 0 {
+		c.JSON(409, gin.H{"message": "Mutation with this key already exists"})
+		return
+	}
+
+	if collisions := findKeyCollisions(mutation.ProjectID, mutation.Key, mutation.ID); len(collisions) > 0 {
+		c.JSON(409, gin.H{"message": "Key collides with existing keys", "collisions": collisions})
+		return
+	}
+
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Model(&mutation).Update("deleted_at", nil).Error; err != nil {
+			return err
+		}
+		// Values of languages deleted in the meantime stay deleted
+		activeLanguages := tx.Model(&db.Language{}).Select("id").Where("project_id = ?", mutation.ProjectID)
+		err := tx.Unscoped().Model(&db.MutationValue{}).
+			Where("mutation_id = ? AND language_id IN (?)", mutation.ID, activeLanguages).
+			Update("deleted_at", nil).Error
+		if err != nil {
+			return err
+		}
+		return history.RecordMutation(tx, c.MustGet("userId").(uint), history.ActionRestore, &mutation, mutation)
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error restoring mutation", "error": err.Error()})
+		return
+	}
+
+	conn.Preload("MutationValues").First(&mutation, mutation.ID)
+	c.JSON(200, mutation.ToSimpleMutation())
+}
+
+// purgeMutations permanently deletes mutations together with all of their values
+func purgeMutations(tx *gorm.DB, mutationIds []uint) error {
+	if len(mutationIds) == 0 {
+		return nil
+	}
+	if err := tx.Unscoped().Where("mutation_id IN ?", mutationIds).Delete(&db.MutationValue{}).Error; err != nil {
+		return err
+	}
+	return tx.Unscoped().Where("id IN ?", mutationIds).Delete(&db.Mutation{}).Error
+}
+
+func PurgeFromTrash(c *gin.Context) {
+	mutation, ok := findTrashed(c)
+	if !ok {
+		return
+	}
+
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		return purgeMutations(tx, []uint{mutation.ID})
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error purging mutation", "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, "Mutation was permanently deleted")
+}
+
+// PurgeExpiredTrash permanently deletes mutations which stayed in the trash longer than the retention
+func PurgeExpiredTrash() error {
+	var mutationIds []uint
+	err := conn.Unscoped().Model(&db.Mutation{}).
+		Where("deleted_at IS NOT NULL AND deleted_at < ?", time.Now().Add(-trashRetention())).
+		Pluck("id", &mutationIds).Error
+	if err != nil {
+		return err
+	}
+
+	return conn.Transaction(func(tx *gorm.DB) error {
+		return purgeMutations(tx, mutationIds)
+	})
+}
+
+// StartTrashPurge runs PurgeExpiredTrash periodically in the background
+func StartTrashPurge(interval time.Duration) {
+	go func() {
+		for {
+			// A failed purge is retried on the next run
+			if err := PurgeExpiredTrash(); err != nil {
+				fmt.Println("Could not purge expired trash:", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
@@ -0,0 +1,37 @@
+package oidc
+
+// Account is a local account carrying the email of the identity
+type Account struct {
+	ID            uint
+	EmailVerified bool
+}
+
+// Resolution tells how an identity without a linked account logs in
+type Resolution int
+
+const (
+	// Provision creates a new account for the identity
+	Provision Resolution = iota
+	// Link links the only account with the email, verified both locally and at the provider
+	Link
+	// Confirm requires the owner of a matching account to confirm the link with their credentials
+	Confirm
+	// Reject refuses the login, no account matches and provisioning is disabled
+	Reject
+)
+
+// Resolve decides how an identity without a linked account logs in, accounts are the local
+// accounts with the email of the identity. An unverified email could be set to anything
+// at the provider, so it never matches accounts.
+func Resolve(identity Claims, accounts []Account, provision bool) (Resolution, uint) {
+	if identity.EmailVerified && len(accounts) > 0 {
+		if len(accounts) == 1 && accounts[0].EmailVerified {
+			return Link, accounts[0].ID
+		}
+		return Confirm, 0
+	}
+	if !provision {
+		return Reject, 0
+	}
+	return Provision, 0
+}
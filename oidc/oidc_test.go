@@ -0,0 +1,178 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testClientID = "language-booster"
+
+// testProvider is an identity provider serving discovery, JWKS and the token endpoint,
+// the token endpoint answers with the ID token built by idToken
+type testProvider struct {
+	server  *httptest.Server
+	key     *rsa.PrivateKey
+	idToken func(code string) string
+}
+
+func startTestProvider(t *testing.T) *testProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &testProvider{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(discovery{
+			Issuer:                provider.server.URL,
+			AuthorizationEndpoint: provider.server.URL + "/authorize",
+			TokenEndpoint:         provider.server.URL + "/token",
+			JwksURI:               provider.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jsonWebKey{{
+			Kty: "RSA",
+			Kid: "key-1",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("code_verifier") == "" {
+			http.Error(w, "invalid_request", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": provider.idToken(r.PostForm.Get("code"))})
+	})
+	provider.server = httptest.NewServer(mux)
+	t.Cleanup(provider.server.Close)
+	return provider
+}
+
+func (provider *testProvider) sign(t *testing.T, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(provider.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func (provider *testProvider) claims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            provider.server.URL,
+		"sub":            "subject-1",
+		"aud":            testClientID,
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"nonce":          nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+	}
+}
+
+func (provider *testProvider) client(t *testing.T) *Provider {
+	client, err := NewProvider(Config{
+		Issuer:      provider.server.URL,
+		ClientID:    testClientID,
+		RedirectURL: "https://example.com/sso/callback",
+		HTTPClient:  provider.server.Client(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestExchangeReturnsVerifiedIdentity(t *testing.T) {
+	provider := startTestProvider(t)
+	provider.idToken = func(code string) string { return provider.sign(t, "key-1", provider.claims("nonce-1")) }
+
+	identity, err := provider.client(t).Exchange("code", "verifier", "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Issuer != provider.server.URL || identity.Subject != "subject-1" || identity.Email != "alice@example.com" || !identity.EmailVerified {
+		t.Errorf("identity = %+v", identity)
+	}
+}
+
+func TestExchangeRejectsInvalidTokens(t *testing.T) {
+	provider := startTestProvider(t)
+	tokens := map[string]func() string{
+		"bad nonce": func() string { return provider.sign(t, "key-1", provider.claims("other-nonce")) },
+		"bad audience": func() string {
+			claims := provider.claims("nonce-1")
+			claims["aud"] = "other-client"
+			return provider.sign(t, "key-1", claims)
+		},
+		"bad issuer": func() string {
+			claims := provider.claims("nonce-1")
+			claims["iss"] = "https://attacker.example.com"
+			return provider.sign(t, "key-1", claims)
+		},
+		"unknown kid": func() string { return provider.sign(t, "key-2", provider.claims("nonce-1")) },
+		"expired": func() string {
+			claims := provider.claims("nonce-1")
+			claims["exp"] = time.Now().Add(-time.Minute).Unix()
+			return provider.sign(t, "key-1", claims)
+		},
+		"symmetric signature": func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, provider.claims("nonce-1"))
+			token.Header["kid"] = "key-1"
+			signed, _ := token.SignedString([]byte("secret"))
+			return signed
+		},
+	}
+
+	for name, idToken := range tokens {
+		t.Run(name, func(t *testing.T) {
+			provider.idToken = func(code string) string { return idToken() }
+			if _, err := provider.client(t).Exchange("code", "verifier", "nonce-1"); err == nil {
+				t.Error("expected the ID token to be rejected")
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	verified := Claims{Subject: "subject-1", Email: "alice@example.com", EmailVerified: true}
+	unverified := Claims{Subject: "subject-1", Email: "alice@example.com"}
+
+	cases := []struct {
+		name       string
+		identity   Claims
+		accounts   []Account
+		provision  bool
+		resolution Resolution
+		userId     uint
+	}{
+		{"links the only verified account", verified, []Account{{ID: 4, EmailVerified: true}}, true, Link, 4},
+		{"confirms an unverified account", verified, []Account{{ID: 4}}, true, Confirm, 0},
+		{"confirms when the email is not unique", verified, []Account{{ID: 4, EmailVerified: true}, {ID: 7, EmailVerified: true}}, true, Confirm, 0},
+		{"provisions without matching accounts", verified, nil, true, Provision, 0},
+		{"ignores accounts for an unverified email", unverified, []Account{{ID: 4, EmailVerified: true}}, true, Provision, 0},
+		{"rejects when provisioning is disabled", verified, nil, false, Reject, 0},
+		{"links even when provisioning is disabled", verified, []Account{{ID: 4, EmailVerified: true}}, false, Link, 4},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resolution, userId := Resolve(c.identity, c.accounts, c.provision)
+			if resolution != c.resolution || userId != c.userId {
+				t.Errorf("Resolve = %v, %d, expected %v, %d", resolution, userId, c.resolution, c.userId)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package plurals
+
+import (
+	"strings"
+)
+
+const (
+	Zero  = "zero"
+	One   = "one"
+	Two   = "two"
+	Few   = "few"
+	Many  = "many"
+	Other = "other"
+)
+
+// AllCategories are the CLDR plural categories in their canonical order
+var AllCategories = []string{Zero, One, Two, Few, Many, Other}
+
+// RuleSet describes the CLDR plural categories of a language
+// together with the gettext representation of the same rules
+type RuleSet struct {
+	Name       string   `json:"name"`
+	Categories []string `json:"categories"`
+	// GettextForms are the categories in msgstr[n] index order
+	GettextForms []string `json:"-"`
+	GettextRule  string   `json:"-"`
+}
+
+var (
+	oneOther = RuleSet{
+		Name:         "one-other",
+		Categories:   []string{One, Other},
+		GettextForms: []string{One, Other},
+		GettextRule:  "nplurals=2; plural=(n != 1);",
+	}
+	otherOnly = RuleSet{
+		Name:         "other",
+		Categories:   []string{Other},
+		GettextForms: []string{Other},
+		GettextRule:  "nplurals=1; plural=0;",
+	}
+	oneUpToTwo = RuleSet{
+		Name:         "one-up-to-two",
+		Categories:   []string{One, Other},
+		GettextForms: []string{One, Other},
+		GettextRule:  "nplurals=2; plural=(n > 1);",
+	}
+	eastSlavic = RuleSet{
+		Name:         "east-slavic",
+		Categories:   []string{One, Few, Many, Other},
+		GettextForms: []string{One, Few, Many},
+		GettextRule:  "nplurals=3; plural=(n%10==1 && n%100!=11 ? 0 : n%10>=2 && n%10<=4 && (n%100<10 || n%100>=20) ? 1 : 2);",
+	}
+	polish = RuleSet{
+		Name:         "polish",
+		Categories:   []string{One, Few, Many, Other},
+		GettextForms: []string{One, Few, Many},
+		GettextRule:  "nplurals=3; plural=(n==1 ? 0 : n%10>=2 && n%10<=4 && (n%100<10 || n%100>=20) ? 1 : 2);",
+	}
+	westSlavic = RuleSet{
+		Name:         "west-slavic",
+		Categories:   []string{One, Few, Many, Other},
+		GettextForms: []string{One, Few, Other},
+		GettextRule:  "nplurals=3; plural=(n==1 ? 0 : n>=2 && n<=4 ? 1 : 2);",
+	}
+	lithuanian = RuleSet{
+		Name:         "lithuanian",
+		Categories:   []string{One, Few, Many, Other},
+		GettextForms: []string{One, Few, Other},
+		GettextRule:  "nplurals=3; plural=(n%10==1 && n%100!=11 ? 0 : n%10>=2 && (n%100<10 || n%100>=20) ? 1 : 2);",
+	}
+	romanian = RuleSet{
+		Name:         "romanian",
+		Categories:   []string{One, Few, Other},
+		GettextForms: []string{One, Few, Other},
+		GettextRule:  "nplurals=3; plural=(n==1 ? 0 : (n==0 || (n%100>0 && n%100<20)) ? 1 : 2);",
+	}
+	hebrew = RuleSet{
+		Name:         "hebrew",
+		Categories:   []string{One, Two, Other},
+		GettextForms: []string{One, Two, Other},
+		GettextRule:  "nplurals=3; plural=(n==1 ? 0 : n==2 ? 1 : 2);",
+	}
+	arabic = RuleSet{
+		Name:         "arabic",
+		Categories:   []string{Zero, One, Two, Few, Many, Other},
+		GettextForms: []string{Zero, One, Two, Few, Many, Other},
+		GettextRule:  "nplurals=6; plural=(n==0 ? 0 : n==1 ? 1 : n==2 ? 2 : n%100>=3 && n%100<=10 ? 3 : n%100>=11 ? 4 : 5);",
+	}
+)
+
+var ruleSetsByLanguage = map[string]RuleSet{
+	"ja": otherOnly, "zh": otherOnly, "ko": otherOnly, "vi": otherOnly, "th": otherOnly, "id": otherOnly, "ms": otherOnly,
+	"fr": oneUpToTwo, "hy": oneUpToTwo, "kab": oneUpToTwo,
+	"ru": eastSlavic, "uk": eastSlavic, "be": eastSlavic,
+	"pl": polish,
+	"cs": westSlavic, "sk": westSlavic,
+	"lt": lithuanian,
+	"ro": romanian, "mo": romanian,
+	"he": hebrew, "iw": hebrew,
+	"ar": arabic,
+}
+
+var ruleSetsByName = map[string]RuleSet{}
+
+func init() {
+	for _, ruleSet := range []RuleSet{oneOther, otherOnly, oneUpToTwo, eastSlavic, polish, westSlavic, lithuanian, romanian, hebrew, arabic} {
+		ruleSetsByName[ruleSet.Name] = ruleSet
+	}
+}
+
+// ForLocale returns the plural rules of the locale's primary language,
+// unknown languages default to the English one/other rules
+func ForLocale(locale string) RuleSet {
+	language := strings.ToLower(locale)
+	if i := strings.IndexAny(language, "-_"); i >= 0 {
+		language = language[:i]
+	}
+	if ruleSet, ok := ruleSetsByLanguage[language]; ok {
+		return ruleSet
+	}
+	return oneOther
+}
+
+// ForLanguage returns the rule set configured on a language,
+// falling back to the rules of its locale
+func ForLanguage(name, locale string) RuleSet {
+	if ruleSet, ok := ruleSetsByName[name]; ok {
+		return ruleSet
+	}
+	return ForLocale(locale)
+}
+
+// ByName returns a rule set by its name
+func ByName(name string) (RuleSet, bool) {
+	ruleSet, ok := ruleSetsByName[name]
+	return ruleSet, ok
+}
+
+func (ruleSet RuleSet) Has(category string) bool {
+	for _, c := range ruleSet.Categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// Missing returns the categories required by the rule set which are not present in forms
+func (ruleSet RuleSet) Missing(forms map[string]string) []string {
+	var missing []string
+	for _, category := range ruleSet.Categories {
+		if _, ok := forms[category]; !ok {
+			missing = append(missing, category)
+		}
+	}
+	return missing
+}
+
+// Unknown returns the categories present in forms which the rule set does not use
+func (ruleSet RuleSet) Unknown(forms map[string]string) []string {
+	var unknown []string
+	for _, category := range AllCategories {
+		if _, ok := forms[category]; ok && !ruleSet.Has(category) {
+			unknown = append(unknown, category)
+		}
+	}
+	for category := range forms {
+		if !isCategory(category) {
+			unknown = append(unknown, category)
+		}
+	}
+	return unknown
+}
+
+func isCategory(category string) bool {
+	for _, c := range AllCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
@@ -2,10 +2,12 @@ package projects
 
 import (
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 	"languageboostergo/auth"
 	"languageboostergo/db"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 var conn = db.GetDb()
@@ -23,18 +25,11 @@ func CreateProject(c *gin.Context) {
 	}
 
 	var foundSpace db.Space
-	conn.Preload("Users").First(&foundSpace, request.SpaceId)
+	conn.First(&foundSpace, request.SpaceId)
 	userId := c.MustGet("userId").(uint)
-	userInSpace := false
-	for _, user := range foundSpace.Users {
-		if user.ID == userId {
-			userInSpace = true
-			break
-		}
-	}
 
-	if !userInSpace {
-		c.JSON(403, "You are not in this space stupid")
+	if !auth.CanInSpace(c, userId, foundSpace.ID, auth.PermissionProjectsManage) {
+		c.JSON(403, "You are not allowed to create projects in this space")
 		return
 	}
 
@@ -57,7 +52,7 @@ func GetById(c *gin.Context) {
 	userId := c.MustGet("userId").(uint)
 	projectId := uint(projectIdParam)
 
-	if !auth.IsUserInProject(userId, projectId) {
+	if !auth.RequestAllowsProject(c, projectId) || !auth.IsUserInProject(userId, projectId) {
 		c.JSON(403, "You cannot update this project")
 		return
 	}
@@ -67,13 +62,19 @@ func GetById(c *gin.Context) {
 	c.JSON(200, foundProject.ToSimpleProject())
 }
 
+type UpdateProjectDto struct {
+	Name string `json:"name"`
+	// SourceLanguageId of 0 removes the source language
+	SourceLanguageId *uint `json:"sourceLanguageId"`
+}
+
 func UpdateProject(c *gin.Context) {
 	projectIdParam, err := strconv.ParseUint(c.Param("projectId"), 10, 32)
 	if err != nil {
 		panic("Project ID is not number serializable")
 	}
 
-	var request CreateProjectDto
+	var request UpdateProjectDto
 	if err := c.ShouldBindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -82,8 +83,13 @@ func UpdateProject(c *gin.Context) {
 	userId := c.MustGet("userId").(uint)
 	projectId := uint(projectIdParam)
 
-	if !auth.IsUserInProject(userId, projectId) {
-		c.JSON(403, "You cannot update this project")
+	if !auth.RequestAllowsProject(c, projectId) || !auth.CanInProject(userId, projectId, auth.PermissionProjectsManage) {
+		c.JSON(403, "You are not allowed to manage this project")
+		return
+	}
+
+	if auth.IsProjectArchived(projectId) {
+		c.JSON(403, "This project is archived and read-only")
 		return
 	}
 
@@ -94,6 +100,20 @@ func UpdateProject(c *gin.Context) {
 		updateData.Name = request.Name
 	}
 
+	if request.SourceLanguageId != nil {
+		if *request.SourceLanguageId == 0 {
+			updateData.SourceLanguageID = nil
+		} else {
+			var language db.Language
+			err := conn.Where("project_id = ?", projectId).First(&language, *request.SourceLanguageId).Error
+			if err != nil {
+				c.JSON(400, gin.H{"message": "Source language does not belong to this project"})
+				return
+			}
+			updateData.SourceLanguageID = &language.ID
+		}
+	}
+
 	conn.Save(&updateData)
 	c.JSON(200, updateData.ToSimpleProject())
 }
@@ -103,23 +123,201 @@ func ListProjects(c *gin.Context) {
 	if err != nil {
 		panic("Space ID is not number serializable")
 	}
+	// Check user relevance
+	userId := c.MustGet("userId").(uint)
+	if !auth.IsUserInSpace(userId, uint(spaceId)) {
+		c.JSON(403, "You are not in this space")
+		return
+	}
+
+	if !auth.MeetsTwoFactorPolicy(userId, uint(spaceId)) {
+		c.JSON(403, "This space requires two-factor authentication, enable it to access its projects")
+		return
+	}
+
+	if !auth.RequestAllowsSpace(c, uint(spaceId)) {
+		c.JSON(403, "This space requires single sign-on, log in with your identity provider to access its projects")
+		return
+	}
+
+	// Archived projects are hidden unless explicitly requested
 	var foundSpace db.Space
-	conn.Preload("Users").Preload("Projects").First(&foundSpace, uint(spaceId))
+	if c.Query("archived") == "true" {
+		conn.Preload("Projects").First(&foundSpace, uint(spaceId))
+	} else {
+		conn.Preload("Projects", "archived_at IS NULL").First(&foundSpace, uint(spaceId))
+	}
+
+	c.JSON(200, foundSpace.ToSimpleSpace().Projects)
+}
+
+// setArchived archives or restores the project from the path
+func setArchived(c *gin.Context, archived bool) {
+	projectIdParam, err := strconv.ParseUint(c.Param("projectId"), 10, 32)
+	if err != nil {
+		panic("Project ID is not number serializable")
+	}
+
+	userId := c.MustGet("userId").(uint)
+	projectId := uint(projectIdParam)
+
+	if !auth.RequestAllowsProject(c, projectId) || !auth.CanInProject(userId, projectId, auth.PermissionProjectsManage) {
+		c.JSON(403, "You are not allowed to manage this project")
+		return
+	}
+
+	var foundProject db.Project
+	conn.First(&foundProject, projectId)
+
+	if archived {
+		now := time.Now()
+		foundProject.ArchivedAt = &now
+	} else {
+		foundProject.ArchivedAt = nil
+	}
+
+	conn.Save(&foundProject)
+	c.JSON(200, foundProject.ToSimpleProject())
+}
+
+func ArchiveProject(c *gin.Context) {
+	setArchived(c, true)
+}
+
+func UnarchiveProject(c *gin.Context) {
+	setArchived(c, false)
+}
+
+func DeleteProject(c *gin.Context) {
+	projectIdParam, err := strconv.ParseUint(c.Param("projectId"), 10, 32)
+	if err != nil {
+		panic("Project ID is not number serializable")
+	}
 
-	// Check user relevance
 	userId := c.MustGet("userId").(uint)
-	userInSpace := false
-	for _, user := range foundSpace.Users {
-		if user.ID == userId {
-			userInSpace = true
-			break
+	projectId := uint(projectIdParam)
+
+	if !auth.RequestAllowsProject(c, projectId) || !auth.CanInProject(userId, projectId, auth.PermissionProjectsManage) {
+		c.JSON(403, "You are not allowed to manage this project")
+		return
+	}
+
+	var foundProject db.Project
+	conn.First(&foundProject, projectId)
+
+	err = conn.Transaction(func(tx *gorm.DB) error {
+		return db.DeleteProjectsCascade(tx, []uint{projectId})
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error deleting project", "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, foundProject.ToSimpleProject())
+}
+
+type UpdateMemberLanguagesDto struct {
+	// LanguageIds restricts the member to these languages, an empty list lifts the restriction
+	LanguageIds []uint `json:"languageIds"`
+}
+
+type MemberLanguagesResponse struct {
+	UserID      uint   `json:"userId"`
+	Restricted  bool   `json:"restricted"`
+	LanguageIds []uint `json:"languageIds"`
+}
+
+// parseMemberParams reads the project and member IDs and checks the caller can manage members
+func parseMemberParams(c *gin.Context) (uint, uint, bool) {
+	projectIdParam, err := strconv.ParseUint(c.Param("projectId"), 10, 32)
+	if err != nil {
+		panic("Project ID is not number serializable")
+	}
+	memberIdParam, err := strconv.ParseUint(c.Param("userId"), 10, 32)
+	if err != nil {
+		panic("User ID is not number serializable")
+	}
+
+	userId := c.MustGet("userId").(uint)
+	projectId := uint(projectIdParam)
+	memberId := uint(memberIdParam)
+
+	if !auth.RequestAllowsProject(c, projectId) || !auth.CanInProject(userId, projectId, auth.PermissionMembersManage) {
+		c.JSON(403, "You are not allowed to manage members of this project")
+		return 0, 0, false
+	}
+
+	if !auth.IsUserInProject(memberId, projectId) {
+		c.JSON(404, "User is not in this project")
+		return 0, 0, false
+	}
+
+	return projectId, memberId, true
+}
+
+func memberLanguages(projectId, memberId uint) MemberLanguagesResponse {
+	var permissions int64
+	conn.Model(&db.LanguagePermission{}).Where("project_id = ? AND user_id = ?", projectId, memberId).Count(&permissions)
+
+	// Permissions of deleted languages only keep the member restricted
+	languageIds := []uint{}
+	conn.Model(&db.LanguagePermission{}).
+		Joins("JOIN languages ON languages.id = language_permissions.language_id AND languages.deleted_at IS NULL").
+		Where("language_permissions.project_id = ? AND language_permissions.user_id = ?", projectId, memberId).
+		Pluck("language_permissions.language_id", &languageIds)
+	return MemberLanguagesResponse{
+		UserID:      memberId,
+		Restricted:  permissions > 0,
+		LanguageIds: languageIds,
+	}
+}
+
+func GetMemberLanguages(c *gin.Context) {
+	projectId, memberId, ok := parseMemberParams(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(200, memberLanguages(projectId, memberId))
+}
+
+func UpdateMemberLanguages(c *gin.Context) {
+	var request UpdateMemberLanguagesDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	projectId, memberId, ok := parseMemberParams(c)
+	if !ok {
+		return
+	}
+
+	if len(request.LanguageIds) > 0 {
+		var count int64
+		conn.Model(&db.Language{}).Where("project_id = ? AND id IN ?", projectId, request.LanguageIds).Count(&count)
+		if int(count) != len(request.LanguageIds) {
+			c.JSON(400, "Some languages do not exist in this project")
+			return
 		}
 	}
 
-	if !userInSpace {
-		c.JSON(403, "You are not in this space")
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("project_id = ? AND user_id = ?", projectId, memberId).Delete(&db.LanguagePermission{}).Error; err != nil {
+			return err
+		}
+		for _, languageId := range request.LanguageIds {
+			permission := db.LanguagePermission{UserID: memberId, ProjectID: projectId, LanguageID: languageId}
+			if err := tx.Create(&permission).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error updating languages", "error": err.Error()})
 		return
 	}
 
-	c.JSON(200, foundSpace.ToSimpleSpace().Projects)
+	c.JSON(200, memberLanguages(projectId, memberId))
 }
@@ -0,0 +1,103 @@
+package projects
+
+import (
+	"github.com/gin-gonic/gin"
+	"languageboostergo/auth"
+	"languageboostergo/db"
+	"languageboostergo/workflow"
+	"net/http"
+	"strconv"
+)
+
+type UpdateWorkflowDto struct {
+	// Workflow resets the project to the default workflow when it is null
+	Workflow *db.Workflow `json:"workflow"`
+}
+
+func GetWorkflow(c *gin.Context) {
+	projectIdParam, err := strconv.ParseUint(c.Param("projectId"), 10, 32)
+	if err != nil {
+		panic("Project ID is not number serializable")
+	}
+
+	userId := c.MustGet("userId").(uint)
+	projectId := uint(projectIdParam)
+
+	if !auth.RequestAllowsProject(c, projectId) || !auth.IsUserInProject(userId, projectId) {
+		c.JSON(403, "You are not in this project")
+		return
+	}
+
+	c.JSON(200, workflow.ForProject(projectId))
+}
+
+// statusesInUse returns the statuses currently used by mutations and values of the project
+func statusesInUse(projectId uint) map[string]bool {
+	var statuses []string
+	conn.Model(&db.Mutation{}).Where("project_id = ?", projectId).Distinct().Pluck("status", &statuses)
+
+	var valueStatuses []string
+	conn.Model(&db.MutationValue{}).
+		Joins("JOIN mutations ON mutations.id = mutation_values.mutation_id AND mutations.deleted_at IS NULL").
+		Where("mutations.project_id = ?", projectId).
+		Distinct().
+		Pluck("mutation_values.status", &valueStatuses)
+
+	inUse := map[string]bool{}
+	for _, status := range append(statuses, valueStatuses...) {
+		inUse[status] = true
+	}
+	return inUse
+}
+
+// UpdateWorkflow replaces the status workflow, states still used by values cannot be removed
+func UpdateWorkflow(c *gin.Context) {
+	projectIdParam, err := strconv.ParseUint(c.Param("projectId"), 10, 32)
+	if err != nil {
+		panic("Project ID is not number serializable")
+	}
+
+	var request UpdateWorkflowDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId := c.MustGet("userId").(uint)
+	projectId := uint(projectIdParam)
+
+	if !auth.RequestAllowsProject(c, projectId) || !auth.CanInProject(userId, projectId, auth.PermissionProjectsManage) {
+		c.JSON(403, "You are not allowed to manage this project")
+		return
+	}
+
+	if auth.IsProjectArchived(projectId) {
+		c.JSON(403, "This project is archived and read-only")
+		return
+	}
+
+	if request.Workflow != nil {
+		if err := workflow.Validate(*request.Workflow); err != nil {
+			c.JSON(400, gin.H{"message": err.Error()})
+			return
+		}
+	}
+
+	current := workflow.ForProject(projectId)
+	updated := workflow.FromConfig(request.Workflow)
+	inUse := statusesInUse(projectId)
+	removed := []string{}
+	for _, state := range current.States {
+		if inUse[state] && !updated.IsState(state) {
+			removed = append(removed, state)
+		}
+	}
+	if len(removed) > 0 {
+		c.JSON(409, gin.H{"message": "States are still used by translations", "states": removed})
+		return
+	}
+
+	conn.Model(&db.Project{}).Where("id = ?", projectId).Update("workflow", request.Workflow)
+
+	c.JSON(200, updated)
+}
@@ -0,0 +1,281 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Key is a JWT key identified by its kid header, keys without a sign key only verify tokens
+type Key struct {
+	ID        string
+	Method    jwt.SigningMethod
+	SignKey   interface{}
+	VerifyKey interface{}
+}
+
+// KeySet signs tokens with one active key and verifies tokens of every key it holds,
+// older keys stay in the set while their tokens are still valid
+type KeySet struct {
+	active *Key
+	keys   map[string]*Key
+	order  []string
+	// legacy verifies tokens without a kid header, which were signed with JWT_SECRET before key rotation
+	legacy *Key
+}
+
+func NewKeySet(active *Key, verifyOnly ...*Key) *KeySet {
+	set := &KeySet{active: active, keys: map[string]*Key{}}
+	set.add(active)
+	for _, key := range verifyOnly {
+		set.add(key)
+	}
+	return set
+}
+
+func (s *KeySet) add(key *Key) {
+	if _, ok := s.keys[key.ID]; ok {
+		return
+	}
+	s.keys[key.ID] = key
+	s.order = append(s.order, key.ID)
+}
+
+// Sign issues a token with the active key and sets its kid header
+func (s *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(s.active.Method, claims)
+	token.Header["kid"] = s.active.ID
+	return token.SignedString(s.active.SignKey)
+}
+
+// Parse verifies the token with the key named by its kid header
+func (s *KeySet) Parse(tokenString string, claims jwt.Claims) error {
+	_, err := jwt.ParseWithClaims(tokenString, claims, s.keyFunc)
+	return err
+}
+
+func (s *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := s.keys[kid]
+	if kid == "" && s.legacy != nil {
+		key, ok = s.legacy, true
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key id: %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.VerifyKey, nil
+}
+
+// DeriveSecret derives a secret for the purpose from the active signing key,
+// so HMAC tokens like password resets work without configuring a separate secret
+func (s *KeySet) DeriveSecret(purpose string) []byte {
+	var material []byte
+	switch k := s.active.SignKey.(type) {
+	case []byte:
+		material = k
+	case *rsa.PrivateKey:
+		material = x509.MarshalPKCS1PrivateKey(k)
+	case ed25519.PrivateKey:
+		material = k.Seed()
+	}
+	mac := hmac.New(sha256.New, material)
+	mac.Write([]byte("languagebooster:" + purpose))
+	return mac.Sum(nil)
+}
+
+// FromEnv loads the key set from the environment:
+//   - JWT_SIGNING_KEY (or JWT_SIGNING_KEY_FILE) is a PEM RSA or Ed25519 private key used for signing,
+//   - JWT_VERIFY_KEYS (or JWT_VERIFY_KEYS_FILE) are PEM keys of previous rotations, still accepted,
+//   - JWT_SECRET signs with HS256 when no signing key is configured, otherwise it only verifies,
+//   - JWT_VERIFY_SECRETS (or JWT_VERIFY_SECRETS_FILE) are previous HS256 secrets, one per line.
+func FromEnv() (*KeySet, error) {
+	signingPEM, err := readEnvOrFile("JWT_SIGNING_KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	var active *Key
+	if signingPEM != "" {
+		keys, err := parseKeys([]byte(signingPEM))
+		if err != nil {
+			return nil, fmt.Errorf("JWT_SIGNING_KEY: %w", err)
+		}
+		if len(keys) != 1 || keys[0].SignKey == nil {
+			return nil, errors.New("JWT_SIGNING_KEY has to contain exactly one private key")
+		}
+		active = keys[0]
+	} else if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		active = hmacKey([]byte(secret))
+	} else {
+		return nil, errors.New("no JWT signing key is configured, set JWT_SIGNING_KEY or JWT_SECRET")
+	}
+
+	verifyPEM, err := readEnvOrFile("JWT_VERIFY_KEYS")
+	if err != nil {
+		return nil, err
+	}
+	verifyKeys, err := parseKeys([]byte(verifyPEM))
+	if err != nil {
+		return nil, fmt.Errorf("JWT_VERIFY_KEYS: %w", err)
+	}
+	for _, key := range verifyKeys {
+		key.SignKey = nil
+	}
+
+	// Keeping JWT_SECRET next to a new signing key keeps the sessions issued before the rotation
+	var legacy *Key
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		legacy = hmacKey([]byte(secret))
+		if signingPEM != "" {
+			legacy.SignKey = nil
+			verifyKeys = append(verifyKeys, legacy)
+		} else {
+			legacy = active
+		}
+	}
+
+	verifySecrets, err := readEnvOrFile("JWT_VERIFY_SECRETS")
+	if err != nil {
+		return nil, err
+	}
+	for _, secret := range strings.Split(verifySecrets, "\n") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			key := hmacKey([]byte(secret))
+			key.SignKey = nil
+			verifyKeys = append(verifyKeys, key)
+		}
+	}
+
+	set := NewKeySet(active, verifyKeys...)
+	set.legacy = legacy
+	return set, nil
+}
+
+// MustFromEnv is FromEnv that stops the application when the keys are missing or broken
+func MustFromEnv() *KeySet {
+	set, err := FromEnv()
+	if err != nil {
+		panic("Failed to load JWT keys: " + err.Error())
+	}
+	return set
+}
+
+var (
+	defaultSet  *KeySet
+	defaultOnce sync.Once
+)
+
+// Default returns the key set shared by the application, loaded once with MustFromEnv
+func Default() *KeySet {
+	defaultOnce.Do(func() {
+		defaultSet = MustFromEnv()
+	})
+	return defaultSet
+}
+
+func readEnvOrFile(name string) (string, error) {
+	if value := os.Getenv(name); value != "" {
+		return value, nil
+	}
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%s_FILE: %w", name, err)
+	}
+	return string(data), nil
+}
+
+// parseKeys reads every PEM block of the data as a key
+func parseKeys(data []byte) ([]*Key, error) {
+	var keys []*Key
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		raw, err := parsePEMBlock(block)
+		if err != nil {
+			return nil, err
+		}
+		key, err := newKey(raw)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 && strings.TrimSpace(string(data)) != "" {
+		return nil, errors.New("no PEM encoded key found")
+	}
+	return keys, nil
+}
+
+func parsePEMBlock(block *pem.Block) (interface{}, error) {
+	switch block.Type {
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+func newKey(raw interface{}) (*Key, error) {
+	key := &Key{}
+	switch k := raw.(type) {
+	case *rsa.PrivateKey:
+		key.Method, key.SignKey, key.VerifyKey = jwt.SigningMethodRS256, k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.Method, key.VerifyKey = jwt.SigningMethodRS256, k
+	case ed25519.PrivateKey:
+		key.Method, key.SignKey, key.VerifyKey = SigningMethodEdDSA, k, k.Public().(ed25519.PublicKey)
+	case ed25519.PublicKey:
+		key.Method, key.VerifyKey = SigningMethodEdDSA, k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, use RSA or Ed25519", raw)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(key.VerifyKey)
+	if err != nil {
+		return nil, err
+	}
+	key.ID = thumbprint(der)
+	return key, nil
+}
+
+func hmacKey(secret []byte) *Key {
+	// The kid must not reveal the secret, so it is derived from a double hash
+	sum := sha256.Sum256(secret)
+	return &Key{
+		ID:        "hs-" + thumbprint(sum[:]),
+		Method:    jwt.SigningMethodHS256,
+		SignKey:   secret,
+		VerifyKey: secret,
+	}
+}
+
+// thumbprint derives a stable kid from the key material
+func thumbprint(data []byte) string {
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
@@ -1,9 +1,11 @@
 package spaces
 
 import (
-	"fmt"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"languageboostergo/auth"
 	"languageboostergo/db"
+	"languageboostergo/oidc"
 	"net/http"
 	"strconv"
 )
@@ -27,8 +29,14 @@ func CreateSpace(c *gin.Context) {
 		Name: request.Name,
 	}
 
+	// The creator becomes the owner of the space
+	conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&newSpace).Error; err != nil {
+			return err
+		}
+		return tx.Create(&db.UserSpace{UserID: user.ID, SpaceID: newSpace.ID, Role: auth.RoleOwner}).Error
+	})
 	newSpace.Users = append(newSpace.Users, user)
-	conn.Save(&newSpace)
 
 	c.JSON(200, newSpace.ToSimpleSpace())
 }
@@ -45,22 +53,19 @@ func GetById(c *gin.Context) {
 	spaceId := uint(spaceIdParam)
 	userId := c.MustGet("userId").(uint)
 
-	var foundSpace db.Space
-	conn.Preload("Projects").Preload("Users").First(&foundSpace, spaceId)
-
-	userIsInSpace := false
-	for _, user := range foundSpace.Users {
-		if user.ID == userId {
-			userIsInSpace = true
-			break
-		}
-	}
-
-	if !userIsInSpace {
+	if !auth.IsUserInSpace(userId, spaceId) {
 		c.JSON(403, "You are not in this space")
 		return
 	}
 
+	// The projects stay hidden until the member meets the two-factor and single sign-on policies
+	var foundSpace db.Space
+	if auth.MeetsTwoFactorPolicy(userId, spaceId) && auth.RequestAllowsSpace(c, spaceId) {
+		conn.Preload("Projects").Preload("Users").First(&foundSpace, spaceId)
+	} else {
+		conn.Preload("Users").First(&foundSpace, spaceId)
+	}
+
 	c.JSON(200, foundSpace.ToSimpleSpace())
 }
 
@@ -71,23 +76,15 @@ func UpdateSpace(c *gin.Context) {
 	}
 	spaceId := uint(spaceIdParam)
 
-	var foundSpace db.Space
-	conn.Preload("Users").First(&foundSpace, spaceId)
-
 	userId := c.MustGet("userId").(uint)
-	userInSpace := false
-	for _, user := range foundSpace.Users {
-		if user.ID == userId {
-			userInSpace = true
-			break
-		}
-	}
-
-	if !userInSpace {
-		c.JSON(403, "You are not in this space, stupid")
+	if !auth.CanInSpace(c, userId, spaceId, auth.PermissionSpaceUpdate) {
+		c.JSON(403, "You are not allowed to update this space")
 		return
 	}
 
+	var foundSpace db.Space
+	conn.Preload("Users").First(&foundSpace, spaceId)
+
 	var request CreateSpaceDto
 	if err := c.ShouldBindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -112,8 +109,10 @@ func LeaveSpace(c *gin.Context) {
 	var foundUser db.User
 	conn.First(&foundUser, c.MustGet("userId").(uint))
 
-	fmt.Println(foundUser)
-	fmt.Println(foundSpace)
+	if isLastOwner(foundUser.ID, spaceId) {
+		c.JSON(400, "You are the last owner of this space, transfer the ownership first")
+		return
+	}
 
 	spaceErr := conn.Model(&foundUser).Association("Spaces").Delete([]db.Space{foundSpace})
 	if spaceErr != nil {
@@ -144,24 +143,30 @@ func AddUserToSpace(c *gin.Context) {
 
 	userUsername := c.Param("username")
 
+	// New members are developers unless a role is requested
+	role := c.DefaultQuery("role", auth.RoleDeveloper)
+
 	var foundSpace db.Space
 	conn.Preload("Users").First(&foundSpace, uint(spaceId))
 
 	// Now we have to check whether user is in this space
 	userId := c.MustGet("userId").(uint)
-	foundUser := false
 	userIsInSpace := false
 	for _, user := range foundSpace.Users {
-		if user.ID == userId {
-			foundUser = true
-		}
 		if user.Username == userUsername {
 			userIsInSpace = true
 		}
 	}
 
-	if !foundUser {
-		c.JSON(403, "You are not in this space stupid")
+	callerRole, _ := auth.RequestSpaceRole(c, userId, foundSpace.ID)
+	if !auth.Can(callerRole, auth.PermissionMembersManage) {
+		c.JSON(403, "You are not allowed to add users to this space")
+		c.Abort()
+		return
+	}
+
+	if !auth.CanAssignRole(callerRole, role) {
+		c.JSON(403, "You are not allowed to assign this role")
 		c.Abort()
 		return
 	}
@@ -186,9 +191,274 @@ func AddUserToSpace(c *gin.Context) {
 		return
 	}
 
+	conn.Create(&db.UserSpace{UserID: newUser.ID, SpaceID: foundSpace.ID, Role: role})
 	foundSpace.Users = append(foundSpace.Users, newUser)
 
-	conn.Save(&foundSpace)
+	c.JSON(200, foundSpace.ToSimpleSpace())
+}
+
+type DeleteSpaceDto struct {
+	// Name has to repeat the name of the space to confirm the deletion
+	Name string `json:"name" binding:"required"`
+}
+
+func DeleteSpace(c *gin.Context) {
+	spaceIdParam, err := strconv.ParseUint(c.Param("spaceId"), 10, 32)
+	if err != nil {
+		panic("Space ID is not number serializable")
+	}
+	spaceId := uint(spaceIdParam)
+
+	userId := c.MustGet("userId").(uint)
+	if !auth.CanInSpace(c, userId, spaceId, auth.PermissionSpaceDelete) {
+		c.JSON(403, "You are not allowed to delete this space")
+		return
+	}
+
+	var foundSpace db.Space
+	conn.Preload("Users").First(&foundSpace, spaceId)
+
+	var request DeleteSpaceDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if request.Name != foundSpace.Name {
+		c.JSON(400, gin.H{"message": "Space name does not match, deletion was not confirmed"})
+		return
+	}
+
+	err = conn.Transaction(func(tx *gorm.DB) error {
+		return db.DeleteSpaceCascade(tx, spaceId)
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error deleting space", "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, foundSpace.ToSimpleSpace())
+}
+
+type SpaceMember struct {
+	User db.SimpleUser `json:"user"`
+	Role string        `json:"role"`
+}
+
+type UpdateMemberRoleDto struct {
+	Role string `json:"role" binding:"required"`
+}
+
+func isLastOwner(userId, spaceId uint) bool {
+	role, ok := auth.SpaceMembership(userId, spaceId)
+	if !ok || role != auth.RoleOwner {
+		return false
+	}
+	var owners int64
+	conn.Model(&db.UserSpace{}).Where("space_id = ? AND role = ?", spaceId, auth.RoleOwner).Count(&owners)
+	return owners <= 1
+}
+
+func ListMembers(c *gin.Context) {
+	spaceIdParam, err := strconv.ParseUint(c.Param("spaceId"), 10, 32)
+	if err != nil {
+		panic("Space ID is not number serializable")
+	}
+	spaceId := uint(spaceIdParam)
+	userId := c.MustGet("userId").(uint)
+
+	if !auth.IsUserInSpace(userId, spaceId) {
+		c.JSON(403, "You are not in this space")
+		return
+	}
+
+	var memberships []db.UserSpace
+	conn.Where("space_id = ?", spaceId).Find(&memberships)
+
+	userIds := make([]uint, len(memberships))
+	for i, membership := range memberships {
+		userIds[i] = membership.UserID
+	}
+
+	var users []db.User
+	conn.Where("id IN ?", userIds).Find(&users)
+	usersById := make(map[uint]db.User, len(users))
+	for _, user := range users {
+		usersById[user.ID] = user
+	}
+
+	members := make([]SpaceMember, 0, len(memberships))
+	for _, membership := range memberships {
+		user, ok := usersById[membership.UserID]
+		if !ok {
+			continue
+		}
+		members = append(members, SpaceMember{User: user.ToSimpleUser(), Role: membership.Role})
+	}
+
+	c.JSON(200, members)
+}
+
+// findManagedMember loads the membership from the path and checks the caller may manage it,
+// admins cannot manage owners
+func findManagedMember(c *gin.Context) (db.UserSpace, string, bool) {
+	spaceIdParam, err := strconv.ParseUint(c.Param("spaceId"), 10, 32)
+	if err != nil {
+		panic("Space ID is not number serializable")
+	}
+	memberIdParam, err := strconv.ParseUint(c.Param("userId"), 10, 32)
+	if err != nil {
+		panic("User ID is not number serializable")
+	}
+
+	var membership db.UserSpace
+	userId := c.MustGet("userId").(uint)
+	callerRole, _ := auth.RequestSpaceRole(c, userId, uint(spaceIdParam))
+	if !auth.Can(callerRole, auth.PermissionMembersManage) {
+		c.JSON(403, "You are not allowed to manage members of this space")
+		return membership, callerRole, false
+	}
+
+	err = conn.Where("space_id = ? AND user_id = ?", uint(spaceIdParam), uint(memberIdParam)).First(&membership).Error
+	if err != nil {
+		c.JSON(404, "User is not in this space")
+		return membership, callerRole, false
+	}
+
+	if membership.Role == auth.RoleOwner && callerRole != auth.RoleOwner {
+		c.JSON(403, "Only owners can manage other owners")
+		return membership, callerRole, false
+	}
+
+	return membership, callerRole, true
+}
+
+func UpdateMemberRole(c *gin.Context) {
+	var request UpdateMemberRoleDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	membership, callerRole, ok := findManagedMember(c)
+	if !ok {
+		return
+	}
+
+	if !auth.CanAssignRole(callerRole, request.Role) {
+		c.JSON(403, "You are not allowed to assign this role")
+		return
+	}
+
+	if request.Role != auth.RoleOwner && isLastOwner(membership.UserID, membership.SpaceID) {
+		c.JSON(400, "The last owner of this space cannot be demoted")
+		return
+	}
+
+	conn.Model(&db.UserSpace{}).Where("space_id = ? AND user_id = ?", membership.SpaceID, membership.UserID).Update("role", request.Role)
+	membership.Role = request.Role
+
+	var user db.User
+	conn.First(&user, membership.UserID)
+	c.JSON(200, SpaceMember{User: user.ToSimpleUser(), Role: membership.Role})
+}
+
+func RemoveMember(c *gin.Context) {
+	membership, _, ok := findManagedMember(c)
+	if !ok {
+		return
+	}
+
+	if isLastOwner(membership.UserID, membership.SpaceID) {
+		c.JSON(400, "The last owner of this space cannot be removed")
+		return
+	}
+
+	conn.Where("space_id = ? AND user_id = ?", membership.SpaceID, membership.UserID).Delete(&db.UserSpace{})
+	c.JSON(200, "User was removed from this space")
+}
+
+type TwoFactorPolicyDto struct {
+	Required *bool `json:"required" binding:"required"`
+}
+
+// UpdateTwoFactorPolicy requires two-factor authentication from all members before they can access projects
+func UpdateTwoFactorPolicy(c *gin.Context) {
+	spaceIdParam, err := strconv.ParseUint(c.Param("spaceId"), 10, 32)
+	if err != nil {
+		panic("Space ID is not number serializable")
+	}
+	spaceId := uint(spaceIdParam)
+
+	userId := c.MustGet("userId").(uint)
+	if !auth.CanInSpace(c, userId, spaceId, auth.PermissionSpaceUpdate) {
+		c.JSON(403, "You are not allowed to update this space")
+		return
+	}
+
+	var request TwoFactorPolicyDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Otherwise the caller would lock themselves out of the projects
+	var foundUser db.User
+	conn.First(&foundUser, userId)
+	if *request.Required && !foundUser.TOTPEnabled {
+		c.JSON(400, "Enable two-factor authentication for yourself first")
+		return
+	}
+
+	var foundSpace db.Space
+	conn.Preload("Users").First(&foundSpace, spaceId)
+	conn.Model(&foundSpace).Update("require_two_factor", *request.Required)
+
+	c.JSON(200, foundSpace.ToSimpleSpace())
+}
+
+type SSOPolicyDto struct {
+	Required *bool `json:"required" binding:"required"`
+}
+
+// UpdateSSOPolicy requires single sign-on to access the projects of the space, password sessions
+// keep working for other spaces but are refused for this one
+func UpdateSSOPolicy(c *gin.Context) {
+	spaceIdParam, err := strconv.ParseUint(c.Param("spaceId"), 10, 32)
+	if err != nil {
+		panic("Space ID is not number serializable")
+	}
+	spaceId := uint(spaceIdParam)
+
+	userId := c.MustGet("userId").(uint)
+	if !auth.CanInSpace(c, userId, spaceId, auth.PermissionSpaceUpdate) {
+		c.JSON(403, "You are not allowed to update this space")
+		return
+	}
+
+	var request SSOPolicyDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if *request.Required {
+		if _, ok := oidc.ConfigFromEnv(); !ok {
+			c.JSON(400, "Single sign-on is not configured")
+			return
+		}
+	}
+
+	// Proves single sign-on works for the caller, who would be locked out otherwise,
+	// and keeps a stolen password from lifting the requirement
+	var foundSpace db.Space
+	conn.Preload("Users").First(&foundSpace, spaceId)
+	if (*request.Required || foundSpace.RequireSSO) && c.GetString("authMethod") != db.AuthMethodSSO {
+		c.JSON(400, "Log in with single sign-on first")
+		return
+	}
+
+	conn.Model(&foundSpace).Update("require_sso", *request.Required)
 
 	c.JSON(200, foundSpace.ToSimpleSpace())
 }
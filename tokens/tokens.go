@@ -0,0 +1,64 @@
+package tokens
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"languageboostergo/signing"
+	"os"
+	"strings"
+)
+
+// Secret reads the signing secret from the environment variable, falling back to JWT_SECRET
+// and then to a secret derived from the JWT signing key, so it never signs with an empty key
+func Secret(name string, keySet *signing.KeySet) []byte {
+	if secret := os.Getenv(name); secret != "" {
+		return []byte(secret)
+	}
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	return keySet.DeriveSecret(name)
+}
+
+// Random returns a URL safe random string of n random bytes
+func Random(n int) (string, error) {
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Hash returns the hex SHA-256 of the token, only hashes are stored in the database
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func sign(secret []byte, value string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewSigned returns a random token signed with the secret together with the hash to store
+func NewSigned(secret []byte) (string, string, error) {
+	value, err := Random(32)
+	if err != nil {
+		return "", "", err
+	}
+	token := value + "." + sign(secret, value)
+	return token, Hash(token), nil
+}
+
+// VerifySigned checks the signature of the token and returns the hash to look it up by
+func VerifySigned(secret []byte, token string) (string, bool) {
+	value, signature, found := strings.Cut(token, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(sign(secret, value))) {
+		return "", false
+	}
+	return Hash(token), true
+}
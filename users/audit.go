@@ -0,0 +1,87 @@
+package users
+
+import (
+	"github.com/gin-gonic/gin"
+	"languageboostergo/auth"
+	"languageboostergo/db"
+	"languageboostergo/loginguard"
+	"strconv"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+func recordLoginAudit(c *gin.Context, username string, userId *uint, outcome string) {
+	conn.Create(&db.LoginAudit{
+		Username:  username,
+		UserID:    userId,
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		Outcome:   outcome,
+	})
+}
+
+// ListLoginAudit shows the latest failed and blocked logins, optionally of a single username
+func ListLoginAudit(c *gin.Context) {
+	userId := c.MustGet("userId").(uint)
+	if !auth.IsAdmin(userId) {
+		c.JSON(403, "You are not an administrator")
+		return
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultAuditLimit
+	}
+	if limit > maxAuditLimit {
+		limit = maxAuditLimit
+	}
+
+	query := conn.Order("created_at desc").Limit(limit)
+	if username := c.Query("username"); username != "" {
+		query = query.Where("username = ?", username)
+	}
+
+	var entries []db.LoginAudit
+	query.Find(&entries)
+
+	c.JSON(200, entries)
+}
+
+// UnlockUser clears the lockout and the failed login counter of the user
+func UnlockUser(c *gin.Context) {
+	unlockedIdParam, err := strconv.ParseUint(c.Param("userId"), 10, 32)
+	if err != nil {
+		panic("User ID is not number serializable")
+	}
+
+	userId := c.MustGet("userId").(uint)
+	if !auth.IsAdmin(userId) {
+		c.JSON(403, "You are not an administrator")
+		return
+	}
+
+	var foundUser db.User
+	if err := conn.First(&foundUser, uint(unlockedIdParam)).Error; err != nil {
+		c.JSON(404, "User does not exist")
+		return
+	}
+
+	if err := loginguard.Default().Unlock(foundUser.Username); err != nil {
+		c.JSON(500, gin.H{"message": "Error unlocking user", "error": err.Error()})
+		return
+	}
+
+	conn.Create(&db.LoginAudit{
+		Username:  foundUser.Username,
+		UserID:    &foundUser.ID,
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		Outcome:   db.LoginUnlocked,
+		ActorID:   &userId,
+	})
+
+	c.JSON(200, foundUser.ToSimpleUser())
+}
@@ -0,0 +1,301 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"languageboostergo/db"
+	"languageboostergo/loginguard"
+	"languageboostergo/mailer"
+	"languageboostergo/signing"
+	"languageboostergo/tokens"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	defaultPasswordMinLength = 8
+	// bcrypt ignores everything after 72 bytes
+	passwordMaxLength       = 72
+	defaultPasswordResetTTL = time.Hour
+)
+
+// PasswordPolicy is configured by PASSWORD_MIN_LENGTH and the PASSWORD_REQUIRE_UPPER,
+// PASSWORD_REQUIRE_LOWER, PASSWORD_REQUIRE_DIGIT and PASSWORD_REQUIRE_SYMBOL flags
+type PasswordPolicy struct {
+	MinLength     int  `json:"minLength"`
+	MaxLength     int  `json:"maxLength"`
+	RequireUpper  bool `json:"requireUpper"`
+	RequireLower  bool `json:"requireLower"`
+	RequireDigit  bool `json:"requireDigit"`
+	RequireSymbol bool `json:"requireSymbol"`
+}
+
+func passwordPolicy() PasswordPolicy {
+	minLength, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH"))
+	if err != nil || minLength <= 0 {
+		minLength = defaultPasswordMinLength
+	}
+	if minLength > passwordMaxLength {
+		minLength = passwordMaxLength
+	}
+	flag := func(name string) bool {
+		value, _ := strconv.ParseBool(os.Getenv(name))
+		return value
+	}
+	return PasswordPolicy{
+		MinLength:     minLength,
+		MaxLength:     passwordMaxLength,
+		RequireUpper:  flag("PASSWORD_REQUIRE_UPPER"),
+		RequireLower:  flag("PASSWORD_REQUIRE_LOWER"),
+		RequireDigit:  flag("PASSWORD_REQUIRE_DIGIT"),
+		RequireSymbol: flag("PASSWORD_REQUIRE_SYMBOL"),
+	}
+}
+
+// Validate returns the rules of the policy the password breaks
+func (policy PasswordPolicy) Validate(password string) []string {
+	violations := []string{}
+	if len([]rune(password)) < policy.MinLength {
+		violations = append(violations, fmt.Sprintf("Password must have at least %d characters", policy.MinLength))
+	}
+	if len(password) > policy.MaxLength {
+		violations = append(violations, fmt.Sprintf("Password must not be longer than %d bytes", policy.MaxLength))
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+	if policy.RequireUpper && !hasUpper {
+		violations = append(violations, "Password must contain an uppercase letter")
+	}
+	if policy.RequireLower && !hasLower {
+		violations = append(violations, "Password must contain a lowercase letter")
+	}
+	if policy.RequireDigit && !hasDigit {
+		violations = append(violations, "Password must contain a digit")
+	}
+	if policy.RequireSymbol && !hasSymbol {
+		violations = append(violations, "Password must contain a symbol")
+	}
+	return violations
+}
+
+// passwordResetTTL is read from PASSWORD_RESET_TTL_MINUTES
+func passwordResetTTL() time.Duration {
+	minutes, err := strconv.Atoi(os.Getenv("PASSWORD_RESET_TTL_MINUTES"))
+	if err != nil || minutes <= 0 {
+		return defaultPasswordResetTTL
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// resetSecret is resolved at startup so a missing key fails early
+var resetSecret = tokens.Secret("PASSWORD_RESET_SECRET", signing.Default())
+
+func passwordResetLink(token string) string {
+	return strings.TrimRight(os.Getenv("APP_URL"), "/") + "/password-reset/" + token
+}
+
+// setPassword stores the new password and revokes every session except the kept one
+func setPassword(tx *gorm.DB, userId uint, password string, keepSessionId uint) error {
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	if err := tx.Model(&db.User{}).Where("id = ?", userId).Update("password", hashedPassword).Error; err != nil {
+		return err
+	}
+	return RevokeUserSessions(tx, userId, keepSessionId)
+}
+
+func GetPasswordPolicy(c *gin.Context) {
+	c.JSON(200, passwordPolicy())
+}
+
+type ChangePasswordDto struct {
+	OldPassword string `json:"oldPassword" binding:"required"`
+	NewPassword string `json:"newPassword" binding:"required"`
+}
+
+// ChangePassword keeps the current session and logs out all other devices
+func ChangePassword(c *gin.Context) {
+	var request ChangePasswordDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId := c.MustGet("userId").(uint)
+	var foundUser db.User
+	conn.First(&foundUser, userId)
+
+	if !checkPassword(request.OldPassword, foundUser.Password) {
+		c.JSON(403, gin.H{"message": "Old password is not correct"})
+		return
+	}
+
+	if violations := passwordPolicy().Validate(request.NewPassword); len(violations) > 0 {
+		c.JSON(400, gin.H{"message": "Password does not meet the policy", "violations": violations})
+		return
+	}
+
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		return setPassword(tx, userId, request.NewPassword, c.GetUint("sessionId"))
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error changing password", "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, "Password was changed")
+}
+
+type ForgotPasswordDto struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// sendPasswordReset replaces the pending reset links of the user with a new one and mails it
+func sendPasswordReset(foundUser db.User) error {
+	token, tokenHash, err := tokens.NewSigned(resetSecret)
+	if err != nil {
+		return err
+	}
+
+	reset := db.PasswordReset{
+		UserID:    foundUser.ID,
+		TokenHash: tokenHash,
+		ExpiresAt: time.Now().Add(passwordResetTTL()),
+	}
+
+	// Only the latest reset link works
+	err = conn.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&db.PasswordReset{}).
+			Where("user_id = ? AND used_at IS NULL", foundUser.ID).
+			Update("used_at", time.Now()).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&reset).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	return mailer.Default().Send(mailer.Message{
+		To:      foundUser.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nsomebody asked to reset the password of your account %s.\n\nSet a new password here:\n%s\n\nThe link expires on %s. If it was not you, ignore this mail.\n",
+			foundUser.Name, foundUser.Username, passwordResetLink(token), reset.ExpiresAt.Format(time.RFC1123),
+		),
+	})
+}
+
+// ForgotPassword mails a reset link, the response is the same whether the email is known or not
+func ForgotPassword(c *gin.Context) {
+	var request ForgotPasswordDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := "If an account with this email exists, a reset link was sent to it"
+	email := strings.ToLower(strings.TrimSpace(request.Email))
+
+	// Emails are not unique, every account of the address gets its own link
+	var foundUsers []db.User
+	conn.Where("LOWER(email) = ?", email).Find(&foundUsers)
+
+	// A failed mail is only logged, answering differently would reveal the email is registered
+	for _, foundUser := range foundUsers {
+		if err := sendPasswordReset(foundUser); err != nil {
+			fmt.Println("Could not send the password reset mail of user", foundUser.ID, ":", err)
+		}
+	}
+
+	c.JSON(200, response)
+}
+
+type ResetPasswordDto struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"newPassword" binding:"required"`
+}
+
+var errResetUsed = errors.New("reset token was already used")
+
+// ResetPassword sets a new password with a reset token and logs out every device
+func ResetPassword(c *gin.Context) {
+	var request ResetPasswordDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tokenHash, ok := tokens.VerifySigned(resetSecret, request.Token)
+	if !ok {
+		c.JSON(400, "Invalid reset token")
+		return
+	}
+
+	var reset db.PasswordReset
+	err := conn.Where("token_hash = ? AND used_at IS NULL", tokenHash).First(&reset).Error
+	if err != nil || time.Now().After(reset.ExpiresAt) {
+		c.JSON(410, gin.H{"message": "Reset token has expired or was already used"})
+		return
+	}
+
+	if violations := passwordPolicy().Validate(request.NewPassword); len(violations) > 0 {
+		c.JSON(400, gin.H{"message": "Password does not meet the policy", "violations": violations})
+		return
+	}
+
+	// The used_at condition makes sure the token can be used only once
+	err = conn.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&db.PasswordReset{}).
+			Where("id = ? AND used_at IS NULL", reset.ID).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errResetUsed
+		}
+		// The token was mailed to the account's email, so using it verifies the email
+		if err := tx.Model(&db.User{}).Where("id = ? AND email_verified_at IS NULL", reset.UserID).Update("email_verified_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return setPassword(tx, reset.UserID, request.NewPassword, 0)
+	})
+	if errors.Is(err, errResetUsed) {
+		c.JSON(410, gin.H{"message": "Reset token has expired or was already used"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error resetting password", "error": err.Error()})
+		return
+	}
+
+	// Proving access to the mailbox also lifts a lockout of the account
+	var foundUser db.User
+	if conn.First(&foundUser, reset.UserID).Error == nil {
+		loginguard.Default().Unlock(foundUser.Username)
+	}
+
+	c.JSON(200, "Password was reset, log in with the new password")
+}
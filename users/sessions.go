@@ -0,0 +1,211 @@
+package users
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"languageboostergo/db"
+	"languageboostergo/tokens"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+	// lastSeenPrecision limits how often the last seen timestamp gets written
+	lastSeenPrecision = time.Minute
+)
+
+// accessTokenTTL is read from ACCESS_TOKEN_TTL_MINUTES
+func accessTokenTTL() time.Duration {
+	minutes, err := strconv.Atoi(os.Getenv("ACCESS_TOKEN_TTL_MINUTES"))
+	if err != nil || minutes <= 0 {
+		return defaultAccessTokenTTL
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// refreshTokenTTL is read from REFRESH_TOKEN_TTL_DAYS
+func refreshTokenTTL() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("REFRESH_TOKEN_TTL_DAYS"))
+	if err != nil || days <= 0 {
+		return defaultRefreshTokenTTL
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+type RefreshTokenDto struct {
+	RefreshToken string `json:"refreshToken" binding:"required"`
+}
+
+type SimpleSession struct {
+	ID         uint      `json:"id"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	AuthMethod string    `json:"authMethod"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Current    bool      `json:"current"`
+}
+
+// touchSession checks the session is active and refreshes its last seen timestamp
+func touchSession(sessionId, userId uint) (db.Session, error) {
+	var session db.Session
+	err := conn.Where("user_id = ? AND revoked_at IS NULL", userId).First(&session, sessionId).Error
+	if err != nil {
+		return session, errors.New("session was revoked")
+	}
+
+	now := time.Now()
+	if now.After(session.ExpiresAt) {
+		return session, errors.New("session has expired")
+	}
+
+	if now.Sub(session.LastSeenAt) > lastSeenPrecision {
+		conn.Model(&session).Update("last_seen_at", now)
+	}
+	return session, nil
+}
+
+// issueTokens writes a new access token and refresh token into the response headers
+func issueTokens(c *gin.Context, session db.Session, refreshToken string) error {
+	accessToken, err := CreateToken(session.UserID, session.ID)
+	if err != nil {
+		return err
+	}
+	c.Writer.Header().Set("Authorization", accessToken)
+	c.Writer.Header().Set("Refresh-Token", refreshToken)
+	return nil
+}
+
+// startSession creates a new session for the device of the request and issues its tokens
+func startSession(c *gin.Context, userId uint, authMethod string) error {
+	refreshToken, err := tokens.Random(32)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	session := db.Session{
+		UserID:           userId,
+		RefreshTokenHash: tokens.Hash(refreshToken),
+		UserAgent:        c.Request.UserAgent(),
+		IP:               c.ClientIP(),
+		AuthMethod:       authMethod,
+		LastSeenAt:       now,
+		ExpiresAt:        now.Add(refreshTokenTTL()),
+	}
+	if err := conn.Create(&session).Error; err != nil {
+		return err
+	}
+
+	return issueTokens(c, session, refreshToken)
+}
+
+// RevokeUserSessions revokes every active session of the user except the kept one
+func RevokeUserSessions(tx *gorm.DB, userId uint, keepSessionId uint) error {
+	return tx.Model(&db.Session{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userId, keepSessionId).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RefreshSession rotates the refresh token and issues a new access token,
+// presenting an already rotated token revokes the whole session as it was likely stolen
+func RefreshSession(c *gin.Context) {
+	var request RefreshTokenDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tokenHash := tokens.Hash(request.RefreshToken)
+
+	var reused db.Session
+	if err := conn.Where("previous_refresh_hash = ?", tokenHash).First(&reused).Error; err == nil {
+		conn.Model(&reused).Update("revoked_at", time.Now())
+		c.JSON(403, gin.H{"message": "Refresh token was already used, the session was revoked"})
+		return
+	}
+
+	var session db.Session
+	err := conn.Where("refresh_token_hash = ? AND revoked_at IS NULL", tokenHash).First(&session).Error
+	if err != nil || time.Now().After(session.ExpiresAt) {
+		c.JSON(403, gin.H{"message": "Invalid refresh token"})
+		return
+	}
+
+	refreshToken, err := tokens.Random(32)
+	if err != nil {
+		c.JSON(500, "Error creating token")
+		return
+	}
+
+	// The hash condition makes the rotation atomic when two refreshes race
+	now := time.Now()
+	result := conn.Model(&db.Session{}).
+		Where("id = ? AND refresh_token_hash = ?", session.ID, tokenHash).
+		Updates(map[string]interface{}{
+			"refresh_token_hash":    tokens.Hash(refreshToken),
+			"previous_refresh_hash": tokenHash,
+			"last_seen_at":          now,
+			"ip":                    c.ClientIP(),
+			"user_agent":            c.Request.UserAgent(),
+			"expires_at":            now.Add(refreshTokenTTL()),
+		})
+	if result.Error != nil || result.RowsAffected == 0 {
+		c.JSON(403, gin.H{"message": "Invalid refresh token"})
+		return
+	}
+
+	if err := issueTokens(c, session, refreshToken); err != nil {
+		c.JSON(500, "Error creating token")
+		return
+	}
+
+	c.JSON(200, "Session was refreshed")
+}
+
+func Logout(c *gin.Context) {
+	sessionId := c.GetUint("sessionId")
+	conn.Model(&db.Session{}).Where("id = ? AND revoked_at IS NULL", sessionId).Update("revoked_at", time.Now())
+	c.JSON(200, "You were logged out")
+}
+
+func LogoutEverywhere(c *gin.Context) {
+	userId := c.MustGet("userId").(uint)
+	if err := RevokeUserSessions(conn, userId, 0); err != nil {
+		c.JSON(500, "Error revoking sessions")
+		return
+	}
+	c.JSON(200, "You were logged out on all devices")
+}
+
+func ListSessions(c *gin.Context) {
+	userId := c.MustGet("userId").(uint)
+	currentSessionId := c.GetUint("sessionId")
+
+	var sessions []db.Session
+	conn.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userId, time.Now()).
+		Order("last_seen_at desc").
+		Find(&sessions)
+
+	simpleSessions := make([]SimpleSession, len(sessions))
+	for i, v := range sessions {
+		simpleSessions[i] = SimpleSession{
+			ID:         v.ID,
+			UserAgent:  v.UserAgent,
+			IP:         v.IP,
+			AuthMethod: v.AuthMethod,
+			CreatedAt:  v.CreatedAt,
+			LastSeenAt: v.LastSeenAt,
+			ExpiresAt:  v.ExpiresAt,
+			Current:    v.ID == currentSessionId,
+		}
+	}
+
+	c.JSON(200, simpleSessions)
+}
@@ -0,0 +1,322 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"languageboostergo/db"
+	"languageboostergo/loginguard"
+	"languageboostergo/oidc"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// ssoFlowTTL is how long the login at the identity provider may take
+	ssoFlowTTL = 10 * time.Minute
+	ssoFlowTyp = "oidc_flow"
+	ssoLinkTyp = "oidc_link"
+)
+
+var (
+	errSSOAccountMissing = errors.New("no account is linked to this identity")
+	errSSOLinkRequired   = errors.New("an account with this email has to confirm the link")
+)
+
+// autoProvision is disabled by OIDC_AUTO_PROVISION=false, only linked or matching accounts may log in then
+func autoProvision() bool {
+	return os.Getenv("OIDC_AUTO_PROVISION") != "false"
+}
+
+type SSOStart struct {
+	AuthorizationURL string `json:"authorizationUrl"`
+	// Flow has to be sent back with the callback, it binds the state, nonce and PKCE verifier
+	Flow string `json:"flow"`
+}
+
+// StartSSO returns the identity provider URL the browser has to be sent to
+func StartSSO(c *gin.Context) {
+	provider, err := oidc.Default()
+	if err != nil {
+		c.JSON(503, gin.H{"message": "Single sign-on is not available", "error": err.Error()})
+		return
+	}
+
+	var values [3]string
+	for i := range values {
+		if values[i], err = oidc.Random(); err != nil {
+			c.JSON(500, "Error starting single sign-on")
+			return
+		}
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	flow, err := keySet.Sign(jwt.MapClaims{
+		"typ":      ssoFlowTyp,
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+		"exp":      time.Now().Add(ssoFlowTTL).Unix(),
+	})
+	if err != nil {
+		c.JSON(500, "Error starting single sign-on")
+		return
+	}
+
+	c.JSON(200, SSOStart{AuthorizationURL: provider.AuthURL(state, nonce, verifier), Flow: flow})
+}
+
+type SSOCallbackDto struct {
+	Code  string `json:"code" binding:"required"`
+	State string `json:"state" binding:"required"`
+	Flow  string `json:"flow" binding:"required"`
+}
+
+// FinishSSO exchanges the authorization code for a session, accounts with TOTP still need
+// their second factor since the identity provider may not check one
+func FinishSSO(c *gin.Context) {
+	var request SSOCallbackDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	provider, err := oidc.Default()
+	if err != nil {
+		c.JSON(503, gin.H{"message": "Single sign-on is not available", "error": err.Error()})
+		return
+	}
+
+	flow := jwt.MapClaims{}
+	if err := keySet.Parse(request.Flow, flow); err != nil || flow["typ"] != ssoFlowTyp || flow["state"] != request.State {
+		c.JSON(400, gin.H{"message": "Invalid or expired single sign-on flow, start again"})
+		return
+	}
+	nonce, _ := flow["nonce"].(string)
+	verifier, _ := flow["verifier"].(string)
+
+	identity, err := provider.Exchange(request.Code, verifier, nonce)
+	if err != nil {
+		c.JSON(403, gin.H{"message": "Identity provider login failed", "error": err.Error()})
+		return
+	}
+
+	var foundUser db.User
+	err = conn.Transaction(func(tx *gorm.DB) error {
+		var err error
+		foundUser, err = findOrProvisionUser(tx, identity)
+		return err
+	})
+	if errors.Is(err, errSSOAccountMissing) {
+		c.JSON(403, gin.H{"message": "No account is linked to this identity, ask an administrator for access"})
+		return
+	}
+	if errors.Is(err, errSSOLinkRequired) {
+		link, err := createSSOLink(identity)
+		if err != nil {
+			c.JSON(500, "Error linking account")
+			return
+		}
+		c.JSON(409, gin.H{"message": "An account with this email exists, confirm the link with its credentials", "linkRequired": true, "link": link})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error linking account", "error": err.Error()})
+		return
+	}
+
+	if foundUser.TOTPEnabled {
+		challenge, err := createTwoFactorChallenge(foundUser.ID, db.AuthMethodSSO)
+		if err != nil {
+			c.JSON(403, "Error creating token")
+			return
+		}
+		c.JSON(200, gin.H{"twoFactorRequired": true, "challenge": challenge})
+		return
+	}
+
+	if err := startSession(c, foundUser.ID, db.AuthMethodSSO); err != nil {
+		c.JSON(403, "Error creating token")
+		return
+	}
+
+	c.JSON(200, foundUser.ToSimpleUser())
+}
+
+// findOrProvisionUser looks the user up by the subject, then links the only account with the
+// same email verified on both sides and finally creates a new account. Other accounts with the
+// email have to confirm the link, otherwise anyone controlling the email at the provider could take them over.
+func findOrProvisionUser(tx *gorm.DB, identity oidc.Claims) (db.User, error) {
+	var user db.User
+
+	var link db.UserIdentity
+	err := tx.Where("issuer = ? AND subject = ?", identity.Issuer, identity.Subject).First(&link).Error
+	if err == nil {
+		return user, tx.First(&user, link.UserID).Error
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return user, err
+	}
+
+	email := strings.ToLower(strings.TrimSpace(identity.Email))
+	var accounts []oidc.Account
+	if email != "" && identity.EmailVerified {
+		var matches []db.User
+		if err := tx.Select("id", "email_verified_at").Where("LOWER(email) = ?", email).Order("id").Find(&matches).Error; err != nil {
+			return user, err
+		}
+		for _, match := range matches {
+			accounts = append(accounts, oidc.Account{ID: match.ID, EmailVerified: match.EmailVerifiedAt != nil})
+		}
+	}
+
+	resolution, userId := oidc.Resolve(identity, accounts, autoProvision())
+	switch resolution {
+	case oidc.Reject:
+		return user, errSSOAccountMissing
+	case oidc.Confirm:
+		return user, errSSOLinkRequired
+	case oidc.Link:
+		if err := tx.First(&user, userId).Error; err != nil {
+			return user, err
+		}
+	case oidc.Provision:
+		username, err := uniqueUsername(tx, identity)
+		if err != nil {
+			return user, err
+		}
+		user = db.User{Name: identity.Name, Username: username}
+		if identity.EmailVerified {
+			now := time.Now()
+			user.Email = email
+			user.EmailVerifiedAt = &now
+		}
+		if user.Name == "" {
+			user.Name = username
+		}
+		// Provisioned accounts have no password, so they can only log in through the provider
+		if err := tx.Create(&user).Error; err != nil {
+			return user, err
+		}
+	}
+
+	return user, tx.Create(&db.UserIdentity{
+		UserID:  user.ID,
+		Issuer:  identity.Issuer,
+		Subject: identity.Subject,
+		Email:   email,
+	}).Error
+}
+
+// createSSOLink carries the verified identity until the owner of the matching account confirms the link
+func createSSOLink(identity oidc.Claims) (string, error) {
+	return keySet.Sign(jwt.MapClaims{
+		"typ":     ssoLinkTyp,
+		"issuer":  identity.Issuer,
+		"subject": identity.Subject,
+		"email":   strings.ToLower(strings.TrimSpace(identity.Email)),
+		"exp":     time.Now().Add(ssoFlowTTL).Unix(),
+	})
+}
+
+type SSOLinkDto struct {
+	Link         string `json:"link" binding:"required"`
+	Username     string `json:"username" binding:"required"`
+	Password     string `json:"password" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+// LinkSSO links the identity to an account with its email once the owner confirmed it
+// with the password and, when enabled, the second factor
+func LinkSSO(c *gin.Context) {
+	var request SSOLinkDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims := jwt.MapClaims{}
+	if err := keySet.Parse(request.Link, claims); err != nil || claims["typ"] != ssoLinkTyp {
+		c.JSON(400, gin.H{"message": "Invalid or expired link, log in with single sign-on again"})
+		return
+	}
+	issuer, _ := claims["issuer"].(string)
+	subject, _ := claims["subject"].(string)
+	email, _ := claims["email"].(string)
+
+	guard := loginguard.Default()
+	now := time.Now()
+	accountKey := loginguard.AccountKey(request.Username)
+	if !checkLoginAttempts(c, guard, now, request.Username, accountKey) {
+		return
+	}
+
+	var foundUser db.User
+	err := conn.Where("username = ? AND LOWER(email) = ?", request.Username, email).First(&foundUser).Error
+	if err != nil {
+		failLogin(c, guard, now, request.Username, nil, db.LoginUnknownUser)
+		return
+	}
+	if !checkPassword(request.Password, foundUser.Password) {
+		failLogin(c, guard, now, request.Username, &foundUser.ID, db.LoginWrongPassword)
+		return
+	}
+	if foundUser.TOTPEnabled && !useSecondFactor(foundUser, request.Code, request.RecoveryCode) {
+		failLogin(c, guard, now, request.Username, &foundUser.ID, db.LoginWrongCode)
+		return
+	}
+
+	err = conn.Transaction(func(tx *gorm.DB) error {
+		// The provider verified the email and the owner proved the account, so the email is verified
+		if err := tx.Model(&db.User{}).Where("id = ? AND email_verified_at IS NULL", foundUser.ID).Update("email_verified_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Create(&db.UserIdentity{
+			UserID:  foundUser.ID,
+			Issuer:  issuer,
+			Subject: subject,
+			Email:   email,
+		}).Error
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error linking account", "error": err.Error()})
+		return
+	}
+
+	guard.Succeed(accountKey)
+
+	if err := startSession(c, foundUser.ID, db.AuthMethodSSO); err != nil {
+		c.JSON(403, "Error creating token")
+		return
+	}
+
+	c.JSON(200, foundUser.ToSimpleUser())
+}
+
+// uniqueUsername derives the username from the claims and adds a number when it is taken
+func uniqueUsername(tx *gorm.DB, identity oidc.Claims) (string, error) {
+	base := identity.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+	if base == "" {
+		base = "user"
+	}
+
+	username := base
+	for i := 2; ; i++ {
+		var count int64
+		if err := tx.Model(&db.User{}).Where("username = ?", username).Count(&count).Error; err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return username, nil
+		}
+		username = fmt.Sprintf("%s%d", base, i)
+	}
+}
@@ -0,0 +1,319 @@
+package users
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"languageboostergo/db"
+	"languageboostergo/loginguard"
+	"languageboostergo/tokens"
+	"languageboostergo/totp"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	recoveryCodeCount = 10
+	// twoFactorChallengeTTL is how long the second login step may take
+	twoFactorChallengeTTL = 5 * time.Minute
+	twoFactorChallengeTyp = "2fa"
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func totpIssuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "LanguageBooster"
+}
+
+// normalizeRecoveryCode ignores case, spaces and dashes the user may type
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(code)))
+}
+
+// replaceRecoveryCodes invalidates the previous codes and returns new ones, they are shown only once
+func replaceRecoveryCodes(tx *gorm.DB, userId uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userId).Delete(&db.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		random := make([]byte, 7)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(random))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		if err := tx.Create(&db.RecoveryCode{UserID: userId, CodeHash: tokens.Hash(code)}).Error; err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// useSecondFactor accepts either a TOTP code or an unused recovery code
+func useSecondFactor(user db.User, code, recoveryCode string) bool {
+	if recoveryCode != "" {
+		result := conn.Model(&db.RecoveryCode{}).
+			Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, tokens.Hash(normalizeRecoveryCode(recoveryCode))).
+			Update("used_at", time.Now())
+		return result.Error == nil && result.RowsAffected > 0
+	}
+
+	step, ok := totp.Validate(user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return false
+	}
+	// The step condition makes sure the code is not accepted twice by concurrent requests
+	result := conn.Model(&db.User{}).
+		Where("id = ? AND totp_last_step < ?", user.ID, step).
+		Update("totp_last_step", step)
+	return result.Error == nil && result.RowsAffected > 0
+}
+
+// createTwoFactorChallenge proves the first factor was correct, it is not accepted as an access token,
+// the session started after the second factor keeps the method of the first one
+func createTwoFactorChallenge(userId uint, authMethod string) (string, error) {
+	return keySet.Sign(jwt.MapClaims{
+		"user_id": userId,
+		"typ":     twoFactorChallengeTyp,
+		"amr":     authMethod,
+		"exp":     time.Now().Add(twoFactorChallengeTTL).Unix(),
+	})
+}
+
+func parseTwoFactorChallenge(challenge string) (uint, string, error) {
+	claims := &jwt.MapClaims{}
+	if err := keySet.Parse(challenge, claims); err != nil {
+		return 0, "", err
+	}
+	userIdClaim, ok := (*claims)["user_id"].(float64)
+	if !ok || (*claims)["typ"] != twoFactorChallengeTyp {
+		return 0, "", errors.New("token is not a two-factor challenge")
+	}
+	authMethod := db.AuthMethodPassword
+	if (*claims)["amr"] == db.AuthMethodSSO {
+		authMethod = db.AuthMethodSSO
+	}
+	return uint(userIdClaim), authMethod, nil
+}
+
+type TwoFactorLoginDto struct {
+	Challenge    string `json:"challenge" binding:"required"`
+	Code         string `json:"code" binding:"required_without=RecoveryCode"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+// LoginTwoFactor is the second login step, it exchanges the challenge and a code for a session
+func LoginTwoFactor(c *gin.Context) {
+	var request TwoFactorLoginDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId, authMethod, err := parseTwoFactorChallenge(request.Challenge)
+	if err != nil {
+		c.JSON(403, gin.H{"message": "Invalid or expired challenge, log in again"})
+		return
+	}
+
+	var foundUser db.User
+	if err := conn.First(&foundUser, userId).Error; err != nil || !foundUser.TOTPEnabled {
+		c.JSON(403, gin.H{"message": "Invalid or expired challenge, log in again"})
+		return
+	}
+
+	guard := loginguard.Default()
+	now := time.Now()
+	accountKey := loginguard.AccountKey(foundUser.Username)
+	if !checkLoginAttempts(c, guard, now, foundUser.Username, accountKey) {
+		return
+	}
+
+	if !useSecondFactor(foundUser, request.Code, request.RecoveryCode) {
+		failLogin(c, guard, now, foundUser.Username, &foundUser.ID, db.LoginWrongCode)
+		return
+	}
+
+	guard.Succeed(accountKey)
+
+	if err := startSession(c, foundUser.ID, authMethod); err != nil {
+		c.JSON(403, "Error creating token")
+		return
+	}
+
+	c.JSON(200, foundUser.ToSimpleUser())
+}
+
+type TwoFactorSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// SetupTwoFactor starts the enrollment, the secret becomes active once a code confirms it
+func SetupTwoFactor(c *gin.Context) {
+	userId := c.MustGet("userId").(uint)
+	var foundUser db.User
+	conn.First(&foundUser, userId)
+
+	if foundUser.TOTPEnabled {
+		c.JSON(400, "Two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		c.JSON(500, "Error creating secret")
+		return
+	}
+
+	conn.Model(&foundUser).Update("totp_pending_secret", secret)
+
+	c.JSON(200, TwoFactorSetup{Secret: secret, URI: totp.URI(totpIssuer(), foundUser.Username, secret)})
+}
+
+type TwoFactorCodeDto struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// EnableTwoFactor confirms the pending secret with a code and returns the recovery codes
+func EnableTwoFactor(c *gin.Context) {
+	var request TwoFactorCodeDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId := c.MustGet("userId").(uint)
+	var foundUser db.User
+	conn.First(&foundUser, userId)
+
+	if foundUser.TOTPEnabled {
+		c.JSON(400, "Two-factor authentication is already enabled")
+		return
+	}
+	if foundUser.TOTPPendingSecret == "" {
+		c.JSON(400, "Set up two-factor authentication first")
+		return
+	}
+
+	step, ok := totp.Validate(foundUser.TOTPPendingSecret, request.Code, time.Now(), 0)
+	if !ok {
+		c.JSON(400, "Code is not valid")
+		return
+	}
+
+	var codes []string
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&foundUser).Updates(map[string]interface{}{
+			"totp_secret":         foundUser.TOTPPendingSecret,
+			"totp_pending_secret": "",
+			"totp_enabled":        true,
+			"totp_last_step":      step,
+		}).Error
+		if err != nil {
+			return err
+		}
+		codes, err = replaceRecoveryCodes(tx, userId)
+		return err
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error enabling two-factor authentication", "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, RecoveryCodes{RecoveryCodes: codes})
+}
+
+type DisableTwoFactorDto struct {
+	Password     string `json:"password" binding:"required"`
+	Code         string `json:"code" binding:"required_without=RecoveryCode"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+// DisableTwoFactor requires both the password and a second factor
+func DisableTwoFactor(c *gin.Context) {
+	var request DisableTwoFactorDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId := c.MustGet("userId").(uint)
+	var foundUser db.User
+	conn.First(&foundUser, userId)
+
+	if !foundUser.TOTPEnabled {
+		c.JSON(400, "Two-factor authentication is not enabled")
+		return
+	}
+	if !checkPassword(request.Password, foundUser.Password) || !useSecondFactor(foundUser, request.Code, request.RecoveryCode) {
+		c.JSON(403, gin.H{"message": "Password or code is not correct"})
+		return
+	}
+
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&foundUser).Updates(map[string]interface{}{
+			"totp_secret":  "",
+			"totp_enabled": false,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userId).Delete(&db.RecoveryCode{}).Error
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error disabling two-factor authentication", "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, "Two-factor authentication was disabled")
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes, a valid TOTP code is required
+func RegenerateRecoveryCodes(c *gin.Context) {
+	var request TwoFactorCodeDto
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userId := c.MustGet("userId").(uint)
+	var foundUser db.User
+	conn.First(&foundUser, userId)
+
+	if !foundUser.TOTPEnabled {
+		c.JSON(400, "Two-factor authentication is not enabled")
+		return
+	}
+	if !useSecondFactor(foundUser, request.Code, "") {
+		c.JSON(403, gin.H{"message": "Code is not correct"})
+		return
+	}
+
+	var codes []string
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = replaceRecoveryCodes(tx, userId)
+		return err
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error creating recovery codes", "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, RecoveryCodes{RecoveryCodes: codes})
+}
@@ -1,18 +1,22 @@
 package users
 
 import (
-	"fmt"
+	"errors"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
 	"languageboostergo/db"
+	"languageboostergo/loginguard"
+	"languageboostergo/signing"
+	"math"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
 var conn = db.GetDb()
-var secret = os.Getenv("JWT_SECRET")
+var keySet = signing.Default()
 
 func hashPassword(password string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 10)
@@ -24,41 +28,50 @@ func checkPassword(password, hash string) bool {
 	return err == nil
 }
 
-func CreateToken(userId uint) (string, error) {
+// CreateToken issues a short-lived access token bound to the session
+func CreateToken(userId, sessionId uint) (string, error) {
 	var err error
 	atClaims := jwt.MapClaims{}
 	atClaims["authorized"] = true
 	atClaims["user_id"] = userId
-	atClaims["exp"] = time.Now().Add(time.Hour * 24 * 30 * 365).Unix() // Token will expire after 1 year
-	at := jwt.NewWithClaims(jwt.SigningMethodHS256, atClaims)
-	token, err := at.SignedString([]byte(secret)) // Replace "your-secret" with your own secret
+	atClaims["sid"] = sessionId
+	atClaims["exp"] = time.Now().Add(accessTokenTTL()).Unix()
+	token, err := keySet.Sign(atClaims)
 	if err != nil {
 		return "", err
 	}
 	return token, nil
 }
 
-func ParseToken(tokenString string) (uint, error) {
+// ParseToken validates the access token and checks its session was not revoked,
+// it returns the user and the session
+func ParseToken(tokenString string) (uint, db.Session, error) {
 	claims := &jwt.MapClaims{}
-	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(secret), nil // Replace with your own secret
-	})
+	err := keySet.Parse(strings.TrimPrefix(tokenString, "Bearer "), claims)
+	if err != nil {
+		return 0, db.Session{}, err
+	}
+
+	userIdClaim, userOk := (*claims)["user_id"].(float64)
+	sessionIdClaim, sessionOk := (*claims)["sid"].(float64)
+	if !userOk || !sessionOk {
+		return 0, db.Session{}, errors.New("token is missing claims")
+	}
+	userId := uint(userIdClaim)
 
+	session, err := touchSession(uint(sessionIdClaim), userId)
 	if err != nil {
-		return 0, err
+		return 0, db.Session{}, err
 	}
-	userId := uint((*claims)["user_id"].(float64))
 
-	return userId, nil
+	return userId, session, nil
 }
 
 type CreateUserDto struct {
 	Name     string `json:"name" binding:"required"`
 	Username string `json:"username" binding:"required"`
-	Password string `json:"password"`
+	Email    string `json:"email" binding:"omitempty,email"`
+	Password string `json:"password" binding:"required"`
 }
 
 func CreateUser(c *gin.Context) {
@@ -76,6 +89,11 @@ func CreateUser(c *gin.Context) {
 		return
 	}
 
+	if violations := passwordPolicy().Validate(request.Password); len(violations) > 0 {
+		c.JSON(400, gin.H{"message": "Password does not meet the policy", "violations": violations})
+		return
+	}
+
 	hashedPassword, passwordErr := hashPassword(request.Password)
 
 	if passwordErr != nil {
@@ -87,18 +105,17 @@ func CreateUser(c *gin.Context) {
 	user := db.User{
 		Name:     request.Name,
 		Username: request.Username,
+		Email:    request.Email,
 		Password: hashedPassword,
 	}
 
 	conn.Create(&user)
 
-	token, tokenErr := CreateToken(user.ID)
-	if tokenErr != nil {
+	if err := startSession(c, user.ID, db.AuthMethodPassword); err != nil {
 		c.JSON(403, "Error creating token")
 		return
 	}
 
-	c.Writer.Header().Set("Authorization", token)
 	c.JSON(200, user.ToSimpleUser())
 }
 
@@ -121,28 +138,87 @@ func LoginUser(c *gin.Context) {
 		return
 	}
 
+	guard := loginguard.Default()
+	now := time.Now()
+	accountKey := loginguard.AccountKey(request.Username)
+	if !checkLoginAttempts(c, guard, now, request.Username, accountKey) {
+		return
+	}
+
 	var foundUser db.User
 	err := conn.Where("username = ?", request.Username).First(&foundUser).Error
 	if err != nil {
-		c.JSON(403, gin.H{"message": "Unauthorized"})
-		c.Abort()
+		failLogin(c, guard, now, request.Username, nil, db.LoginUnknownUser)
 		return
 	}
 
 	if !checkPassword(request.Password, foundUser.Password) {
-		c.JSON(403, gin.H{"message": "Unauthorized"})
-		c.Abort()
+		failLogin(c, guard, now, request.Username, &foundUser.ID, db.LoginWrongPassword)
+		return
+	}
+
+	// The counter is cleared only after the second factor, otherwise knowing the password
+	// would allow guessing codes without limit
+	if foundUser.TOTPEnabled {
+		challenge, err := createTwoFactorChallenge(foundUser.ID, db.AuthMethodPassword)
+		if err != nil {
+			c.JSON(403, "Error creating token")
+			return
+		}
+		c.JSON(200, gin.H{"twoFactorRequired": true, "challenge": challenge})
 		return
 	}
 
-	token, tokenErr := CreateToken(foundUser.ID)
+	guard.Succeed(accountKey)
 
-	if tokenErr != nil {
+	if err := startSession(c, foundUser.ID, db.AuthMethodPassword); err != nil {
 		c.JSON(403, "Error creating token")
 		return
 	}
 
-	c.Writer.Header().Set("Authorization", token)
-
 	c.JSON(200, foundUser.ToSimpleUser())
 }
+
+// checkLoginAttempts refuses the login while the account or the IP address is throttled or locked
+func checkLoginAttempts(c *gin.Context, guard *loginguard.Guard, now time.Time, username, accountKey string) bool {
+	wait, locked, err := guard.Check(now, accountKey, loginguard.IPKey(c.ClientIP()))
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error checking login attempts", "error": err.Error()})
+		return false
+	}
+	if wait > 0 {
+		outcome := db.LoginThrottled
+		if locked {
+			outcome = db.LoginLocked
+		}
+		recordLoginAudit(c, username, nil, outcome)
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		c.JSON(http.StatusTooManyRequests, gin.H{"message": "Too many failed login attempts, try again later", "retryAfter": retryAfter})
+		return false
+	}
+	return true
+}
+
+// failLogin counts the failure and answers the same way for unknown users and wrong passwords
+func failLogin(c *gin.Context, guard *loginguard.Guard, now time.Time, username string, userId *uint, outcome string) {
+	recordLoginAudit(c, username, userId, outcome)
+
+	locked, err := guard.Fail(now, loginguard.AccountKey(username), loginguard.IPKey(c.ClientIP()))
+	if err != nil {
+		c.JSON(500, gin.H{"message": "Error counting login attempt", "error": err.Error()})
+		c.Abort()
+		return
+	}
+	if locked {
+		recordLoginAudit(c, username, userId, db.LoginLocked)
+	}
+
+	c.JSON(403, gin.H{"message": "Unauthorized"})
+	c.Abort()
+}
+
+// GetJWKS publishes the public keys so other services can validate access tokens
+func GetJWKS(c *gin.Context) {
+	c.JSON(200, keySet.JWKS())
+}
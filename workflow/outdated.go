@@ -0,0 +1,62 @@
+package workflow
+
+import (
+	"gorm.io/gorm"
+	"languageboostergo/db"
+	"languageboostergo/history"
+)
+
+// MarkOutdated flips the translations of the mutation to OUTDATED when its source value changed.
+// The source text a translation was made from is kept until the translation is updated,
+// so after several source changes translators still see the whole difference
+func MarkOutdated(tx *gorm.DB, userId uint, before, after db.MutationValue) error {
+	if before.Value == after.Value && history.SamePlurals(before.Plurals, after.Plurals) {
+		return nil
+	}
+
+	var mutation db.Mutation
+	if err := tx.Select("id", "project_id").First(&mutation, after.MutationId).Error; err != nil {
+		return err
+	}
+	var project db.Project
+	if err := tx.Select("id", "source_language_id").First(&project, mutation.ProjectID).Error; err != nil {
+		return err
+	}
+	if project.SourceLanguageID == nil || *project.SourceLanguageID != after.LanguageId {
+		return nil
+	}
+
+	// Untranslated values have nothing which could be outdated
+	var translations []db.MutationValue
+	err := tx.Where("mutation_id = ? AND language_id <> ? AND status <> ?", after.MutationId, after.LanguageId, db.StatusNeedsTranslation).
+		Find(&translations).Error
+	if err != nil {
+		return err
+	}
+
+	for _, translation := range translations {
+		if translation.Value == "" && len(translation.Plurals) == 0 {
+			continue
+		}
+
+		previous := translation
+		if translation.Status != db.StatusOutdated {
+			translation.OldSourceValue = before.Value
+		}
+		translation.Status = db.StatusOutdated
+		translation.NewSourceValue = after.Value
+
+		err := tx.Model(&db.MutationValue{}).Where("id = ?", translation.ID).Updates(map[string]interface{}{
+			"status":           translation.Status,
+			"old_source_value": translation.OldSourceValue,
+			"new_source_value": translation.NewSourceValue,
+		}).Error
+		if err != nil {
+			return err
+		}
+		if err := history.RecordMutationValue(tx, userId, history.ActionUpdate, &previous, translation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"languageboostergo/auth"
+	"languageboostergo/db"
+	"regexp"
+)
+
+var conn = db.GetDb()
+
+// AnyState matches every status as the origin of a transition
+const AnyState = "*"
+
+var (
+	ErrUnknownState  = errors.New("status is not part of the workflow")
+	ErrNoTransition  = errors.New("status change is not allowed by the workflow")
+	ErrNotPermitted  = errors.New("your role is not allowed to make this status change")
+	stateNamePattern = regexp.MustCompile(`^[A-Z][A-Z0-9_]{0,63}$`)
+)
+
+// BuiltInStates exist in every project, custom states are added to them
+var BuiltInStates = []string{
+	db.StatusNeedsTranslation, db.StatusTranslated, db.StatusInReview,
+	db.StatusApproved, db.StatusRejected, db.StatusOutdated,
+}
+
+// DefaultTransitions let translators work on values and leave approval to reviewers
+var DefaultTransitions = []db.WorkflowTransition{
+	{From: db.StatusNeedsTranslation, To: db.StatusTranslated, Permission: string(auth.PermissionValuesWrite)},
+	{From: db.StatusTranslated, To: db.StatusInReview, Permission: string(auth.PermissionValuesWrite)},
+	{From: db.StatusRejected, To: db.StatusTranslated, Permission: string(auth.PermissionValuesWrite)},
+	{From: db.StatusOutdated, To: db.StatusTranslated, Permission: string(auth.PermissionValuesWrite)},
+	{From: db.StatusOutdated, To: db.StatusInReview, Permission: string(auth.PermissionValuesWrite)},
+	{From: db.StatusTranslated, To: db.StatusApproved, Permission: string(auth.PermissionValuesReview)},
+	{From: db.StatusInReview, To: db.StatusApproved, Permission: string(auth.PermissionValuesReview)},
+	{From: db.StatusInReview, To: db.StatusRejected, Permission: string(auth.PermissionValuesReview)},
+	{From: db.StatusApproved, To: db.StatusInReview, Permission: string(auth.PermissionValuesReview)},
+	{From: db.StatusApproved, To: db.StatusTranslated, Permission: string(auth.PermissionValuesWrite)},
+	{From: AnyState, To: db.StatusNeedsTranslation, Permission: string(auth.PermissionValuesWrite)},
+	{From: AnyState, To: db.StatusOutdated, Permission: string(auth.PermissionValuesWrite)},
+}
+
+// editedStates are tried in order for an approved value whose text changed
+var editedStates = []string{db.StatusTranslated, db.StatusInReview, db.StatusNeedsTranslation}
+
+// transitionPermissions are the permissions a transition may require
+var transitionPermissions = []auth.Permission{auth.PermissionValuesWrite, auth.PermissionValuesReview, auth.PermissionKeysWrite}
+
+// Workflow is the effective workflow of a project
+type Workflow struct {
+	Initial     string                  `json:"initial"`
+	States      []string                `json:"states"`
+	Transitions []db.WorkflowTransition `json:"transitions"`
+	Custom      bool                    `json:"custom"`
+}
+
+func Default() Workflow {
+	return Workflow{
+		Initial:     db.StatusNeedsTranslation,
+		States:      BuiltInStates,
+		Transitions: DefaultTransitions,
+	}
+}
+
+// FromConfig combines the custom configuration of a project with the built-in states
+func FromConfig(config *db.Workflow) Workflow {
+	if config == nil {
+		return Default()
+	}
+	workflow := Workflow{
+		Initial:     db.StatusNeedsTranslation,
+		States:      append([]string{}, BuiltInStates...),
+		Transitions: config.Transitions,
+		Custom:      true,
+	}
+	for _, state := range config.States {
+		if !workflow.IsState(state) {
+			workflow.States = append(workflow.States, state)
+		}
+	}
+	return workflow
+}
+
+// ForProject loads the workflow of the project
+func ForProject(projectId uint) Workflow {
+	var project db.Project
+	if err := conn.Select("id", "workflow").First(&project, projectId).Error; err != nil {
+		return Default()
+	}
+	return FromConfig(project.Workflow)
+}
+
+func (workflow Workflow) IsState(state string) bool {
+	for _, s := range workflow.States {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// Check validates the status change for the role, keeping the status is always allowed
+func (workflow Workflow) Check(role, from, to string) error {
+	if from == to {
+		return nil
+	}
+	if !workflow.IsState(to) {
+		return ErrUnknownState
+	}
+
+	exists := false
+	for _, transition := range workflow.Transitions {
+		if transition.To != to || (transition.From != from && transition.From != AnyState) {
+			continue
+		}
+		exists = true
+		if auth.Can(role, auth.Permission(transition.Permission)) {
+			return nil
+		}
+	}
+	if exists {
+		return ErrNotPermitted
+	}
+	return ErrNoTransition
+}
+
+// EditedStatus is the status of a value after its text changed without a requested status,
+// approved text has to be reviewed again so it moves to the first state the role may reach
+func (workflow Workflow) EditedStatus(role, status string) (string, error) {
+	if status != db.StatusApproved {
+		return status, nil
+	}
+	var err error
+	for _, state := range editedStates {
+		if err = workflow.Check(role, status, state); err == nil {
+			return state, nil
+		}
+	}
+	return status, err
+}
+
+// CheckInitial validates the status of a new mutation or value as a change from the initial status
+func (workflow Workflow) CheckInitial(role, status string) error {
+	if status == "" {
+		return nil
+	}
+	return workflow.Check(role, workflow.Initial, status)
+}
+
+// Error describes a failed check for the API response
+func Error(err error, from, to string) string {
+	return fmt.Sprintf("%s: %s -> %s", err.Error(), from, to)
+}
+
+// StatusCode is 403 when only the role is missing and 400 when the change is invalid
+func StatusCode(err error) int {
+	if errors.Is(err, ErrNotPermitted) {
+		return 403
+	}
+	return 400
+}
+
+// Validate checks a custom configuration before it is saved
+func Validate(config db.Workflow) error {
+	workflow := FromConfig(&config)
+	for _, state := range config.States {
+		if !stateNamePattern.MatchString(state) {
+			return fmt.Errorf("state %q has to be upper case letters, digits and underscores", state)
+		}
+	}
+	if len(config.Transitions) == 0 {
+		return errors.New("workflow needs at least one transition")
+	}
+	for _, transition := range config.Transitions {
+		if transition.From != AnyState && !workflow.IsState(transition.From) {
+			return fmt.Errorf("transition from unknown state %q", transition.From)
+		}
+		if !workflow.IsState(transition.To) {
+			return fmt.Errorf("transition to unknown state %q", transition.To)
+		}
+		if !isTransitionPermission(auth.Permission(transition.Permission)) {
+			return fmt.Errorf("transition %s -> %s has an unsupported permission %q", transition.From, transition.To, transition.Permission)
+		}
+	}
+	return nil
+}
+
+func isTransitionPermission(permission auth.Permission) bool {
+	for _, p := range transitionPermissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}